@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// audit_log is append-only: a trigger rejects deletes and any update except
+// removing personal data, which erasure and retention have to do.
+
+var (
+	// auditPersonalFields are dropped from recorded changes when the person
+	// is erased or their bookings are anonymized.
+	auditPersonalFields = []string{"name", "surname", "email", "phone"}
+	// auditSecretFields are recorded as changed without their values.
+	auditSecretFields = []string{"password", "api_key", "secret"}
+)
+
+type AuditChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+type AuditEntry struct {
+	Id         int                    `json:"id"`
+	ActorId    *int                   `json:"actor_id"`
+	ActorEmail *string                `json:"actor_email"`
+	Action     string                 `json:"action"`
+	Entity     string                 `json:"entity"`
+	EntityId   *int                   `json:"entity_id"`
+	IP         string                 `json:"ip"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	Changes    map[string]AuditChange `json:"changes,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+}
+
+// recordAudit appends an entry to the audit log. Failing to write it is
+// logged but never fails the request that triggered it.
+func recordAudit(actorId int, action, entity string, entityId int, ip string, details map[string]interface{}) {
+	if err := writeAudit(db, actorId, action, entity, entityId, ip, details, nil); err != nil {
+		log.Print(err)
+	}
+}
+
+// recordChange appends an entry with the fields that differ between before
+// and after. before is nil for new records and after for deleted ones. It
+// runs in the caller's transaction, so the change and its entry are saved
+// together or not at all.
+func recordChange(q queryer, actorId int, action, entity string, entityId int, ip string, before, after interface{}) error {
+	changes, err := auditDiff(before, after)
+	if err != nil {
+		return err
+	}
+	return writeAudit(q, actorId, action, entity, entityId, ip, nil, changes)
+}
+
+func writeAudit(q queryer, actorId int, action, entity string, entityId int, ip string, details map[string]interface{}, changes map[string]AuditChange) error {
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit details: %v", err)
+	}
+	var changesJSON []byte
+	if changes != nil {
+		if changesJSON, err = json.Marshal(changes); err != nil {
+			return fmt.Errorf("failed to marshal audit changes: %v", err)
+		}
+	}
+	_, err = q.Exec(
+		"INSERT INTO audit_log (actor_id, action, entity, entity_id, ip, details, changes) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		sql.NullInt64{Int64: int64(actorId), Valid: actorId != 0},
+		action,
+		entity,
+		sql.NullInt64{Int64: int64(entityId), Valid: entityId != 0},
+		ip,
+		detailsJSON,
+		sql.NullString{String: string(changesJSON), Valid: changes != nil},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return nil
+}
+
+// auditFields turns a record into its JSON fields so records of any type can
+// be compared.
+func auditFields(record interface{}) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if record == nil {
+		return fields, nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal audit record: %v", err)
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("failed to read audit record: %v", err)
+	}
+	return fields, nil
+}
+
+func auditDiff(before, after interface{}) (map[string]AuditChange, error) {
+	from, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	to, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+	for key := range to {
+		if _, ok := from[key]; !ok {
+			from[key] = nil
+		}
+	}
+
+	changes := map[string]AuditChange{}
+	for key, old := range from {
+		value := to[key]
+		if reflect.DeepEqual(old, value) || (isEmptyAuditValue(old) && isEmptyAuditValue(value)) {
+			continue
+		}
+		if contains(auditSecretFields, key) {
+			old, value = "[redacted]", "[redacted]"
+		}
+		changes[key] = AuditChange{From: old, To: value}
+	}
+	return changes, nil
+}
+
+func isEmptyAuditValue(value interface{}) bool {
+	return value == nil || value == "" || value == float64(0) || value == false
+}
+
+// auditLogHandler lists audit entries, newest first. Filters: actor_id,
+// action, entity, entity_id, ip, from and to (dates, inclusive).
+func auditLogHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	var from, to sql.NullString
+	for _, bound := range []struct {
+		name  string
+		value *sql.NullString
+	}{{"from", &from}, {"to", &to}} {
+		if value := query.Get(bound.name); value != "" {
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				http.Error(w, fmt.Sprintf("%s must look like 2025-05-01", bound.name), http.StatusBadRequest)
+				return
+			}
+			*bound.value = sql.NullString{String: value, Valid: true}
+		}
+	}
+	page := queryInt(r, "page", 1)
+	if page < 1 {
+		page = 1
+	}
+
+	rows, err := db.Query(`
+        SELECT audit_log.id, audit_log.actor_id, users.email, audit_log.action, audit_log.entity, audit_log.entity_id,
+            COALESCE(audit_log.ip, ''), audit_log.details, audit_log.changes, audit_log.created_at
+        FROM audit_log
+        LEFT JOIN users ON users.id = audit_log.actor_id
+        WHERE ($1 = 0 OR audit_log.actor_id = $1)
+            AND ($2 = '' OR audit_log.action = $2)
+            AND ($3 = '' OR audit_log.entity = $3)
+            AND ($4 = 0 OR audit_log.entity_id = $4)
+            AND ($5 = '' OR audit_log.ip = $5)
+            AND ($6::date IS NULL OR audit_log.created_at >= $6::date)
+            AND ($7::date IS NULL OR audit_log.created_at < $7::date + 1)
+        ORDER BY audit_log.id DESC
+        LIMIT 100 OFFSET $8
+    `, queryInt(r, "actor_id", 0), query.Get("action"), query.Get("entity"), queryInt(r, "entity_id", 0), query.Get("ip"), from, to, (page-1)*100)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var details, changes []byte
+		err := rows.Scan(&e.Id, &e.ActorId, &e.ActorEmail, &e.Action, &e.Entity, &e.EntityId, &e.IP, &details, &changes, &e.CreatedAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan audit entry: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if details != nil {
+			json.Unmarshal(details, &e.Details)
+		}
+		if changes != nil {
+			json.Unmarshal(changes, &e.Changes)
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAuditDiff(t *testing.T) {
+	type record struct {
+		Name     string `json:"name"`
+		Role     string `json:"role"`
+		Service  int    `json:"service"`
+		Disabled bool   `json:"disabled"`
+		Password string `json:"password,omitempty"`
+	}
+
+	tests := []struct {
+		name          string
+		before, after interface{}
+		want          map[string]AuditChange
+	}{
+		{
+			"created",
+			nil,
+			record{Name: "Anna", Role: "stylist"},
+			map[string]AuditChange{
+				"name": {From: nil, To: "Anna"},
+				"role": {From: nil, To: "stylist"},
+			},
+		},
+		{
+			"updated",
+			record{Name: "Anna", Role: "stylist", Service: 1},
+			record{Name: "Anna", Role: "owner", Service: 2},
+			map[string]AuditChange{
+				"role":    {From: "stylist", To: "owner"},
+				"service": {From: float64(1), To: float64(2)},
+			},
+		},
+		{
+			"deleted",
+			record{Name: "Anna", Disabled: true},
+			nil,
+			map[string]AuditChange{
+				"name":     {From: "Anna", To: nil},
+				"disabled": {From: true, To: nil},
+			},
+		},
+		{
+			"unchanged",
+			record{Name: "Anna", Role: "owner"},
+			record{Name: "Anna", Role: "owner"},
+			map[string]AuditChange{},
+		},
+		{
+			"empty values are equivalent",
+			map[string]interface{}{"phone": nil, "note": ""},
+			map[string]interface{}{"phone": "", "count": 0},
+			map[string]AuditChange{},
+		},
+		{
+			"secrets are redacted",
+			record{Name: "Anna", Password: "old-hash"},
+			record{Name: "Anna", Password: "new-hash"},
+			map[string]AuditChange{
+				"password": {From: "[redacted]", To: "[redacted]"},
+			},
+		},
+		{
+			"unchanged secrets are left out",
+			map[string]interface{}{"api_key": "abc"},
+			map[string]interface{}{"api_key": "abc"},
+			map[string]AuditChange{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := auditDiff(tt.before, tt.after)
+			if err != nil {
+				t.Fatalf("auditDiff: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("auditDiff = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditDiffUnmarshalable(t *testing.T) {
+	if _, err := auditDiff(nil, map[string]interface{}{"bad": make(chan int)}); err == nil {
+		t.Error("auditDiff accepted a record that can't be marshalled")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	RoleOwner        = "owner"
+	RoleReceptionist = "receptionist"
+	RoleStylist      = "stylist"
+	RoleCustomer     = "customer"
+)
+
+type Permission string
+
+const (
+	PermViewAllBookings   Permission = "bookings:view_all"
+	PermManageBookings    Permission = "bookings:manage"
+	PermManageOwnBookings Permission = "bookings:manage_own"
+	PermBookOnBehalf      Permission = "bookings:on_behalf"
+	PermManageUsers       Permission = "users:manage"
+	PermManagePricing     Permission = "services:manage"
+	PermManageSettings    Permission = "settings:manage"
+	PermViewAuditLog      Permission = "audit:view"
+)
+
+// rolePermissions lists what each role may do. Stylists only get access to
+// bookings assigned to them, which handlers check against stylist_id.
+var rolePermissions = map[string][]Permission{
+	RoleOwner: {
+		PermViewAllBookings,
+		PermManageBookings,
+		PermManageOwnBookings,
+		PermBookOnBehalf,
+		PermManageUsers,
+		PermManagePricing,
+		PermManageSettings,
+		PermViewAuditLog,
+	},
+	RoleReceptionist: {
+		PermViewAllBookings,
+		PermManageBookings,
+		PermBookOnBehalf,
+	},
+	RoleStylist: {
+		PermManageOwnBookings,
+	},
+	RoleCustomer: {},
+}
+
+// Scopes limit what a personal access token can do on top of the owner's
+// role. Sessions and legacy API keys are not scoped.
+const (
+	ScopeBookingsRead  = "bookings:read"
+	ScopeBookingsWrite = "bookings:write"
+	ScopeAdmin         = "admin"
+)
+
+var permissionScopes = map[Permission]string{
+	PermViewAllBookings:   ScopeBookingsRead,
+	PermManageBookings:    ScopeBookingsWrite,
+	PermManageOwnBookings: ScopeBookingsWrite,
+	PermBookOnBehalf:      ScopeBookingsWrite,
+	PermManageUsers:       ScopeAdmin,
+	PermManagePricing:     ScopeAdmin,
+	PermManageSettings:    ScopeAdmin,
+}
+
+func isValidScope(scope string) bool {
+	return scope == ScopeBookingsRead || scope == ScopeBookingsWrite || scope == ScopeAdmin
+}
+
+func isValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Principal is the authenticated caller of a request. SessionId is set when
+// the caller used a session access token, TokenId when they used a personal
+// access token, and neither for a legacy API key. NeedsTOTP marks staff who
+// must enroll in two-factor authentication before using their role.
+type Principal struct {
+	UserId    int
+	Email     string
+	Role      string
+	SessionId int
+	TokenId   int
+	Scopes    []string
+	NeedsTOTP bool
+}
+
+func (p *Principal) Can(perm Permission) bool {
+	if p == nil || p.NeedsTOTP || !p.HasScope(permissionScopes[perm]) {
+		return false
+	}
+	for _, granted := range rolePermissions[p.Role] {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the credential allows the given scope. Only
+// personal access tokens are restricted; the admin scope allows everything.
+func (p *Principal) HasScope(scope string) bool {
+	if p == nil {
+		return false
+	}
+	if p.TokenId == 0 {
+		return true
+	}
+	for _, granted := range p.Scopes {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) IsStaff() bool {
+	return p != nil && p.Role != RoleCustomer
+}
+
+func (p *Principal) Permissions() []Permission {
+	if p == nil {
+		return nil
+	}
+	return rolePermissions[p.Role]
+}
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+type principalKey struct{}
+
+// authenticate resolves the Authorization header to a user. It accepts a
+// session access token or a legacy API key, with or without a "Bearer "
+// prefix, and returns a nil principal when the header is absent.
+func authenticate(r *http.Request) (*Principal, error) {
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if token == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(token, accessTokenPrefix) {
+		return authenticateAccessToken(token)
+	}
+
+	var p Principal
+	err := db.QueryRow(`
+        SELECT users.id, users.email, users.role, sessions.id FROM sessions
+        JOIN users ON users.id = sessions.user_id
+        WHERE sessions.access_token_hash = $1 AND sessions.revoked_at IS NULL AND sessions.access_expires_at > NOW()
+            AND users.disabled_at IS NULL
+    `, hashToken(token)).Scan(&p.UserId, &p.Email, &p.Role, &p.SessionId)
+	if err == nil {
+		return &p, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to validate session: %v", err)
+	}
+
+	err = db.QueryRow("SELECT id, email, role FROM users WHERE api_key = $1 AND disabled_at IS NULL", token).Scan(&p.UserId, &p.Email, &p.Role)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate API key: %v", err)
+	}
+	return &p, nil
+}
+
+// currentPrincipal returns the caller stored by withAuth, or nil for
+// anonymous requests.
+func currentPrincipal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+// withAuth authenticates the caller if credentials were sent. Anonymous
+// requests are let through; invalid credentials are rejected.
+func withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, done := r.Context().Value(principalKey{}).(*Principal); done {
+			next(w, r)
+			return
+		}
+		p, err := authenticate(r)
+		if err == errInvalidCredentials {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if err == nil && p.IsStaff() {
+			p.NeedsTOTP, err = needsTOTPEnrollment(p.UserId)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to authenticate: %v", err), http.StatusInternalServerError)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// requireLogin only lets authenticated callers through.
+func requireLogin(next http.HandlerFunc) http.HandlerFunc {
+	return withAuth(func(w http.ResponseWriter, r *http.Request) {
+		if currentPrincipal(r) == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// requirePermission only lets callers through whose role grants at least one
+// of the given permissions.
+func requirePermission(next http.HandlerFunc, perms ...Permission) http.HandlerFunc {
+	return requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		p := currentPrincipal(r)
+		for _, perm := range perms {
+			if p.Can(perm) {
+				next(w, r)
+				return
+			}
+		}
+		if p.NeedsTOTP {
+			http.Error(w, "Two-factor authentication must be enabled for staff accounts", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
+
+// withScope rejects personal access tokens that lack the given scope.
+// Anonymous callers are let through for the handler to deal with.
+func withScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return withAuth(func(w http.ResponseWriter, r *http.Request) {
+		p := currentPrincipal(r)
+		if p != nil && !p.HasScope(scope) {
+			http.Error(w, fmt.Sprintf("Token is missing the %s scope", scope), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// canManageBooking reports whether the caller may edit or cancel a booking.
+// Stylists are limited to the bookings assigned to them.
+func canManageBooking(p *Principal, bookingId int) (bool, error) {
+	if p.Can(PermManageBookings) {
+		return true, nil
+	}
+	if !p.Can(PermManageOwnBookings) {
+		return false, nil
+	}
+	var stylistId sql.NullInt64
+	err := db.QueryRow("SELECT stylist_id FROM bookings WHERE id = $1", bookingId).Scan(&stylistId)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch booking: %v", err)
+	}
+	return stylistId.Valid && int(stylistId.Int64) == p.UserId, nil
+}
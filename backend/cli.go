@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const cliUsage = `Usage:
+  main                              start the server
+  main gdpr export EMAIL [FILE]     export personal data as JSON, or as a ZIP archive into FILE
+  main gdpr erase EMAIL             delete the account and anonymize bookings
+  main retention report [MONTHS]    show what the retention policy would anonymize
+  main retention apply              anonymize now using BOOKING_RETENTION_MONTHS`
+
+// runCommand handles the maintenance commands that can be run next to the
+// server, e.g. docker compose exec backend ./main gdpr export jan@example.com
+func runCommand(args []string) int {
+	switch args[0] {
+	case "gdpr":
+		return runGDPRCommand(args[1:])
+	case "retention":
+		return runRetentionCommand(args[1:])
+	}
+	fmt.Fprintln(os.Stderr, cliUsage)
+	return 2
+}
+
+func runGDPRCommand(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, cliUsage)
+		return 2
+	}
+	email := args[1]
+
+	switch args[0] {
+	case "export":
+		data, err := collectPersonalData(email)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		recordAudit(0, "gdpr.exported", "email", 0, "cli", map[string]interface{}{"email": email})
+		if len(args) < 3 {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(data)
+			return 0
+		}
+		f, err := os.Create(args[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		if err := writeExportZip(f, data); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Exported personal data of %s to %s\n", email, args[2])
+	case "erase":
+		result, err := erasePersonalData(email, 0, "cli")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		recordAudit(0, "gdpr.erased", "email", 0, "cli", map[string]interface{}{"result": result})
+		fmt.Printf("Erased personal data: %v\n", result)
+	default:
+		fmt.Fprintln(os.Stderr, cliUsage)
+		return 2
+	}
+	return 0
+}
+
+func runRetentionCommand(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, cliUsage)
+		return 2
+	}
+	months, enforced := bookingRetentionMonths()
+
+	switch args[0] {
+	case "report":
+		if len(args) > 1 {
+			var err error
+			months, err = strconv.Atoi(args[1])
+			if err != nil || months <= 0 {
+				fmt.Fprintln(os.Stderr, "Invalid months:", args[1])
+				return 2
+			}
+		}
+		report, err := retentionReport(months)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	case "apply":
+		if !enforced {
+			fmt.Fprintln(os.Stderr, "BOOKING_RETENTION_MONTHS is not set")
+			return 1
+		}
+		if err := enforceRetention(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("Retention policy applied")
+	default:
+		fmt.Fprintln(os.Stderr, cliUsage)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Subject-access exports and erasure work on an email address rather than a
+// user ID, so they also cover guests who booked without an account.
+
+const anonymizedName = "Anonymized"
+
+var errEraseOwner = errors.New("owner accounts cannot be erased, change the role first")
+
+type PersonalData struct {
+	Email      string                   `json:"email"`
+	ExportedAt time.Time                `json:"exported_at"`
+	Account    map[string]interface{}   `json:"account"`
+	Bookings   []map[string]interface{} `json:"bookings"`
+	Emails     []map[string]interface{} `json:"emails"`
+	// Outbox holds emails that are queued or were sent through the outbox.
+	Outbox     []map[string]interface{} `json:"outbox"`
+	Sessions   []map[string]interface{} `json:"sessions"`
+	Identities []map[string]interface{} `json:"identities"`
+	SMS        []map[string]interface{} `json:"sms"`
+	// Notifications holds the preferences that differ from the defaults.
+	Notifications []map[string]interface{} `json:"notifications"`
+}
+
+// queryMaps runs a query and returns every row as a column name to value map.
+func queryMaps(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		row := map[string]interface{}{}
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[column] = values[i]
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func collectPersonalData(email string) (*PersonalData, error) {
+	data := &PersonalData{Email: email, ExportedAt: time.Now()}
+
+	var userId int
+	err := db.QueryRow("SELECT id FROM users WHERE LOWER(email) = LOWER($1)", email).Scan(&userId)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to fetch user: %v", err)
+	}
+
+	// Secrets such as the password hash, API key and TOTP secret are left out.
+	accounts, err := queryMaps("SELECT id, name, surname, email, pending_email, role, email_verified_at, created_at, totp_enabled FROM users WHERE id = $1", userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user: %v", err)
+	}
+	if len(accounts) > 0 {
+		data.Account = accounts[0]
+	}
+	data.Bookings, err = queryMaps(`
+        SELECT bookings.id, bookings.name, bookings.surname, bookings.email, bookings.phone, services.name AS service,
+            bookings.start_time, bookings.end_time, bookings.user_id, bookings.created_by, bookings.stylist_id
+        FROM bookings LEFT JOIN services ON services.id = bookings.service
+        WHERE bookings.user_id = $1 OR LOWER(bookings.email) = LOWER($2)
+        ORDER BY bookings.start_time
+    `, userId, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch bookings: %v", err)
+	}
+	data.Emails, err = queryMaps("SELECT recipient, subject, body, sent_at FROM sent_emails WHERE LOWER(recipient) = LOWER($1) ORDER BY sent_at", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch emails: %v", err)
+	}
+	data.Outbox, err = queryMaps("SELECT recipient, subject, body, status, created_at, sent_at FROM email_outbox WHERE LOWER(recipient) = LOWER($1) ORDER BY created_at", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch queued emails: %v", err)
+	}
+	data.SMS, err = queryMaps(`
+        SELECT recipient, body, status, created_at, sent_at FROM sms_outbox
+        WHERE booking_id IN (SELECT id FROM bookings WHERE user_id = $1 OR LOWER(email) = LOWER($2))
+        ORDER BY created_at
+    `, userId, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch text messages: %v", err)
+	}
+	data.Notifications, err = queryMaps(`
+        SELECT notification_preferences.channel, notification_preferences.category, notification_preferences.enabled, notification_preferences.updated_at
+        FROM notification_preferences
+        JOIN notification_profiles ON notification_profiles.id = notification_preferences.profile_id
+        WHERE notification_profiles.user_id = $1 OR LOWER(notification_profiles.email) = LOWER($2)
+    `, userId, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch notification preferences: %v", err)
+	}
+	data.Sessions, err = queryMaps("SELECT created_at, revoked_at, user_agent, ip FROM sessions WHERE user_id = $1 ORDER BY created_at", userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sessions: %v", err)
+	}
+	data.Identities, err = queryMaps("SELECT issuer, subject, created_at FROM user_identities WHERE user_id = $1", userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch identities: %v", err)
+	}
+	return data, nil
+}
+
+// writeExportZip writes one JSON file per section of the export.
+func writeExportZip(w io.Writer, data *PersonalData) error {
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"account.json", data.Account},
+		{"bookings.json", data.Bookings},
+		{"emails.json", data.Emails},
+		{"outbox.json", data.Outbox},
+		{"sessions.json", data.Sessions},
+		{"identities.json", data.Identities},
+		{"sms.json", data.SMS},
+		{"notifications.json", data.Notifications},
+	}
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %v", file.name, err)
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.content); err != nil {
+			return fmt.Errorf("failed to write %s: %v", file.name, err)
+		}
+	}
+	return zw.Close()
+}
+
+func writeExport(w http.ResponseWriter, r *http.Request, data *PersonalData) {
+	if r.URL.Query().Get("format") == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "personal-data.zip"))
+		if err := writeExportZip(w, data); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to write export: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// erasePersonalData deletes the account registered to the email and strips
+// personal details from its bookings. Past bookings are kept anonymized so
+// revenue reports still add up; upcoming ones are cancelled on behalf of
+// actorId.
+func erasePersonalData(email string, actorId int, ip string) (map[string]int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start erasure: %v", err)
+	}
+	defer tx.Rollback()
+
+	var userId int
+	var role string
+	err = tx.QueryRow("SELECT id, role FROM users WHERE LOWER(email) = LOWER($1) FOR UPDATE", email).Scan(&userId, &role)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to fetch user: %v", err)
+	}
+	if role == RoleOwner {
+		return nil, errEraseOwner
+	}
+
+	type step struct {
+		name  string
+		query string
+		args  []interface{}
+	}
+	result := map[string]int64{}
+	run := func(steps []step) error {
+		for _, step := range steps {
+			res, err := tx.Exec(step.query, step.args...)
+			if err != nil {
+				return fmt.Errorf("failed to erase personal data (%s): %v", step.name, err)
+			}
+			result[step.name], _ = res.RowsAffected()
+		}
+		return nil
+	}
+
+	err = run([]step{
+		{"scrubbed_sms", "UPDATE sms_outbox SET recipient = '', body = '' WHERE booking_id IN (SELECT id FROM bookings WHERE user_id = $1 OR LOWER(email) = LOWER($2))", []interface{}{userId, email}},
+		{"deleted_digest_items", "DELETE FROM notification_digest_items WHERE booking_id IN (SELECT id FROM bookings WHERE user_id = $1 OR LOWER(email) = LOWER($2))", []interface{}{userId, email}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Upcoming bookings are cancelled the way staff would cancel them, so
+	// the stylist and integrations hear about it. The steps below strip the
+	// customer from the webhook payloads and audit entries this adds.
+	result["cancelled_bookings"], err = cancelUpcomingBookings(tx, userId, email, actorId, ip)
+	if err != nil {
+		return nil, err
+	}
+	err = run([]step{
+		// Changes recorded for the bookings keep who did what, without the customer.
+		{"scrubbed_booking_audit_entries", `
+            UPDATE audit_log SET changes = changes - $3::text[]
+            WHERE entity = 'booking' AND changes IS NOT NULL AND (
+                entity_id IN (SELECT id FROM bookings WHERE user_id = $1 OR LOWER(email) = LOWER($2))
+                OR LOWER(changes->'email'->>'from') = LOWER($2) OR LOWER(changes->'email'->>'to') = LOWER($2)
+            )`, []interface{}{userId, email, pq.Array(auditPersonalFields)}},
+		// Webhook payloads carry copies of bookings and accounts.
+		{"scrubbed_webhook_deliveries", `
+            UPDATE webhook_deliveries SET payload = jsonb_set(payload::jsonb, '{data}', (payload::jsonb->'data') - $3::text[])::text
+            WHERE LOWER(payload::jsonb #>> '{data,email}') = LOWER($2)
+                OR (event LIKE 'booking.%' AND (
+                    (payload::jsonb #>> '{data,id}')::int IN (SELECT id FROM bookings WHERE user_id = $1 OR LOWER(email) = LOWER($2))
+                    OR ($1 <> 0 AND (payload::jsonb #>> '{data,user_id}')::int = $1)
+                ))
+                OR (event LIKE 'user.%' AND (payload::jsonb #>> '{data,id}')::int = $1)`, []interface{}{userId, email, pq.Array(auditPersonalFields)}},
+		{"anonymized_bookings", "UPDATE bookings SET " + anonymizeBookingColumns + " WHERE user_id = $1 OR LOWER(email) = LOWER($2)", []interface{}{userId, email}},
+		{"deleted_emails", "DELETE FROM sent_emails WHERE LOWER(recipient) = LOWER($1)", []interface{}{email}},
+		{"deleted_outbox_emails", "DELETE FROM email_outbox WHERE LOWER(recipient) = LOWER($1)", []interface{}{email}},
+		{"deleted_login_attempts", "DELETE FROM login_attempts WHERE email = $1", []interface{}{normalizeEmail(email)}},
+		{"deleted_notification_profiles", "DELETE FROM notification_profiles WHERE LOWER(email) = LOWER($1)", []interface{}{email}},
+		{"scrubbed_audit_entries", "UPDATE audit_log SET details = NULL, changes = NULL WHERE entity = 'user' AND entity_id = $1", []interface{}{userId}},
+		// Entries about other records may still mention the address, e.g. a
+		// subject-access export or an email change.
+		{"scrubbed_audit_mentions", `
+            UPDATE audit_log SET
+                details = CASE WHEN POSITION(LOWER($1) IN LOWER(details::text)) > 0 THEN NULL ELSE details END,
+                changes = CASE WHEN POSITION(LOWER($1) IN LOWER(changes::text)) > 0 THEN changes - $2::text[] ELSE changes END
+            WHERE POSITION(LOWER($1) IN LOWER(COALESCE(details::text, '') || COALESCE(changes::text, ''))) > 0`, []interface{}{email, pq.Array(auditPersonalFields)}},
+		// Sessions, tokens and identities go with the account.
+		{"deleted_accounts", "DELETE FROM users WHERE id = $1", []interface{}{userId}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to erase personal data: %v", err)
+	}
+	return result, nil
+}
+
+// cancelUpcomingBookings deletes the person's upcoming bookings like
+// deleteBookingHandler does, recording and publishing each one.
+func cancelUpcomingBookings(tx *sql.Tx, userId int, email string, actorId int, ip string) (int64, error) {
+	rows, err := tx.Query(
+		"DELETE FROM bookings WHERE (user_id = $1 OR LOWER(email) = LOWER($2)) AND start_time > NOW() AT TIME ZONE $3 RETURNING "+bookingColumns,
+		userId, email, salonTimezone(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to cancel bookings: %v", err)
+	}
+	defer rows.Close()
+	var cancelled []Booking
+	for rows.Next() {
+		var b Booking
+		err := rows.Scan(&b.Id, &b.UserId, &b.CreatedBy, &b.StylistId, &b.Name, &b.Surname, &b.Email, &b.Phone, &b.Service, &b.StartTime, &b.EndTime, &b.Language)
+		if err != nil {
+			return 0, fmt.Errorf("failed to scan booking: %v", err)
+		}
+		cancelled = append(cancelled, b)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to cancel bookings: %v", err)
+	}
+	rows.Close()
+
+	for _, b := range cancelled {
+		if err := publishBookingEvent(tx, EventBookingCancelled, b); err != nil {
+			return 0, err
+		}
+		if err := recordChange(tx, actorId, "booking.deleted", "booking", b.Id, ip, b, nil); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(cancelled)), nil
+}
+
+func exportMyDataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokenProfileChanges(w, r) {
+		return
+	}
+	caller := currentPrincipal(r)
+	data, err := collectPersonalData(caller.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(caller.UserId, "gdpr.exported", "user", caller.UserId, clientIP(r), nil)
+	writeExport(w, r, data)
+}
+
+func deleteMyAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokenProfileChanges(w, r) {
+		return
+	}
+	caller := currentPrincipal(r)
+
+	var body struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !checkPassword(w, caller.UserId, body.Password) {
+		return
+	}
+
+	result, err := erasePersonalData(caller.Email, 0, clientIP(r))
+	if err == errEraseOwner {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(0, "gdpr.erased", "user", caller.UserId, clientIP(r), map[string]interface{}{"result": result})
+	w.WriteHeader(http.StatusOK)
+}
+
+// exportPersonalDataHandler answers subject-access requests made to the salon,
+// for customers with or without an account.
+func exportPersonalDataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := strings.TrimSpace(r.URL.Query().Get("email"))
+	if email == "" {
+		http.Error(w, "Missing email", http.StatusBadRequest)
+		return
+	}
+	data, err := collectPersonalData(email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(currentPrincipal(r).UserId, "gdpr.exported", "email", 0, clientIP(r), map[string]interface{}{"email": email})
+	writeExport(w, r, data)
+}
+
+func erasePersonalDataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Email string `json:"email"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || strings.TrimSpace(body.Email) == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	result, err := erasePersonalData(body.Email, currentPrincipal(r).UserId, clientIP(r))
+	if err == errEraseOwner {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The audit entry must not bring back the address that was just erased.
+	recordAudit(currentPrincipal(r).UserId, "gdpr.erased", "email", 0, clientIP(r), map[string]interface{}{"result": result})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -4,10 +4,12 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"log"
+	"math"
 	"net/http"
-	"net/smtp"
-	"os"
+
+	"github.com/lib/pq"
 )
 
 var db *sql.DB
@@ -22,13 +24,7 @@ func createBookingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	apiKey := r.Header.Get("Authorization")
-	if apiKey != "" {
-		if valid, _ := validateAPIKey(apiKey); !valid {
-			http.Error(w, "Invalid API key", http.StatusUnauthorized)
-			return
-		}
-	}
+	caller := currentPrincipal(r)
 
 	var b Booking
 	err := json.NewDecoder(r.Body).Decode(&b)
@@ -41,26 +37,83 @@ func createBookingHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Booking conflict", http.StatusConflict)
 		return
 	}
-	v, err = isEmailRegistered(b.Email, apiKey)
-	if v || err != nil {
-		http.Error(w, "Email already registered", http.StatusConflict)
-		return
-	}
 	if b.Service == 0 {
 		b.Service = 1
 	}
 
-	err = db.QueryRow("SELECT id FROM users WHERE api_key = $1", apiKey).Scan(&b.UserId)
-	if err != nil {
-		valid, _ := validateUserExistence(b.Email)
-		if valid {
-			http.Error(w, "User already exists, please log in or use another e-mail", http.StatusConflict)
+	callerId := 0
+	if caller != nil {
+		callerId = caller.UserId
+	}
+
+	if caller.Can(PermBookOnBehalf) {
+		// Staff book on behalf of a customer: either an explicit user, a
+		// registered email or a guest who has no account yet.
+		if b.OnBehalfOf == 0 && b.Email != "" {
+			err = db.QueryRow("SELECT id FROM users WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NOT NULL", b.Email).Scan(&b.OnBehalfOf)
+			if err != nil && err != sql.ErrNoRows {
+				http.Error(w, fmt.Sprintf("Failed to fetch customer: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		if b.OnBehalfOf != 0 {
+			var customer User
+			err = db.QueryRow("SELECT name, surname, email FROM users WHERE id = $1 AND email_verified_at IS NOT NULL", b.OnBehalfOf).Scan(&customer.Name, &customer.Surname, &customer.Email)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Customer not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to fetch customer: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if b.Name == "" {
+				b.Name = customer.Name
+			}
+			if b.Surname == "" {
+				b.Surname = customer.Surname
+			}
+			b.Email = customer.Email
+		}
+		b.UserId = b.OnBehalfOf
+		b.CreatedBy = callerId
+	} else {
+		if b.OnBehalfOf != 0 {
+			http.Error(w, "Only staff can book on behalf of other users", http.StatusForbidden)
 			return
 		}
+		v, err = isEmailRegistered(b.Email, caller)
+		if v || err != nil {
+			http.Error(w, "Email already registered", http.StatusConflict)
+			return
+		}
+		if callerId == 0 {
+			valid, _ := validateUserExistence(b.Email)
+			if valid {
+				http.Error(w, "User already exists, please log in or use another e-mail", http.StatusConflict)
+				return
+			}
+		}
+		b.UserId = callerId
+		// created_by is only kept for bookings staff make for someone else.
+		b.CreatedBy = 0
+	}
+	if !isValidLanguage(b.Language) {
+		b.Language = ""
+		if b.UserId != 0 {
+			b.Language = userLanguage(b.UserId)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to insert booking: %v", err), http.StatusInternalServerError)
+		return
 	}
+	defer tx.Rollback()
 
-	_, err = db.Exec(
-		"INSERT INTO bookings (name, surname, email, phone, service, start_time, end_time, user_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+	err = tx.QueryRow(
+		"INSERT INTO bookings (name, surname, email, phone, service, start_time, end_time, user_id, created_by, stylist_id, language) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id",
 		b.Name,
 		b.Surname,
 		b.Email,
@@ -68,15 +121,32 @@ func createBookingHandler(w http.ResponseWriter, r *http.Request) {
 		b.Service,
 		b.StartTime,
 		b.EndTime,
-		b.UserId,
-	)
+		sql.NullInt64{Int64: int64(b.UserId), Valid: b.UserId != 0},
+		sql.NullInt64{Int64: int64(b.CreatedBy), Valid: b.CreatedBy != 0},
+		sql.NullInt64{Int64: int64(b.StylistId), Valid: b.StylistId != 0},
+		sql.NullString{String: b.Language, Valid: b.Language != ""},
+	).Scan(&b.Id)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to insert booking: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	notifyBookingCreated(b.Name, b.Surname, b.Email, b.StartTime, b.EndTime)
-	confirmBookingCreated(b.Name, b.Surname, b.Email, b.StartTime, b.EndTime)
+	if err := publishBookingEvent(tx, EventBookingCreated, b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordChange(tx, callerId, "booking.created", "booking", b.Id, clientIP(r), nil, b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := confirmBookingCreated(tx, b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to insert booking: %v", err), http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
 }
@@ -98,7 +168,7 @@ func createBookingHandlerGuest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Booking conflict", http.StatusConflict)
 		return
 	}
-	v, err = isEmailRegistered(b.Email, "")
+	v, err = isEmailRegistered(b.Email, nil)
 	if v || err != nil {
 		http.Error(w, "Email already registered", http.StatusConflict)
 		return
@@ -107,8 +177,15 @@ func createBookingHandlerGuest(w http.ResponseWriter, r *http.Request) {
 		b.Service = 1
 	}
 
-	_, err = db.Exec(
-		"INSERT INTO bookings (name, surname, email, phone, service, start_time, end_time) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to insert booking: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		"INSERT INTO bookings (name, surname, email, phone, service, start_time, end_time, stylist_id, language) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
 		b.Name,
 		b.Surname,
 		b.Email,
@@ -116,46 +193,42 @@ func createBookingHandlerGuest(w http.ResponseWriter, r *http.Request) {
 		b.Service,
 		b.StartTime,
 		b.EndTime,
-	)
+		sql.NullInt64{Int64: int64(b.StylistId), Valid: b.StylistId != 0},
+		sql.NullString{String: b.Language, Valid: isValidLanguage(b.Language)},
+	).Scan(&b.Id)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to insert booking: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	notifyBookingCreated(b.Name, b.Surname, b.Email, b.StartTime, b.EndTime)
-	confirmBookingCreated(b.Name, b.Surname, b.Email, b.StartTime, b.EndTime)
+	if err := publishBookingEvent(tx, EventBookingCreated, b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordChange(tx, 0, "booking.created", "booking", b.Id, clientIP(r), nil, b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := confirmBookingCreated(tx, b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to insert booking: %v", err), http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
 }
 
 func getBookingsHandler(w http.ResponseWriter, r *http.Request) {
-	loggedIn := false
-	isAdmin := false
-	id := -1
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	apiKey := r.Header.Get("Authorization")
-	if apiKey != "" {
-		if valid, _ := validateAPIKey(apiKey); !valid {
-			http.Error(w, "Invalid API key", http.StatusUnauthorized)
-			return
-		}
-		loggedIn = true
-		err := db.QueryRow("SELECT id FROM users WHERE api_key = $1", apiKey).Scan(&id)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to fetch user ID: %v", err), http.StatusInternalServerError)
-			return
-		}
-		isAdmin, err = validateAdmin(apiKey)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to validate admin: %v", err), http.StatusInternalServerError)
-			return
-		}
-	}
+	caller := currentPrincipal(r)
 
-	rows, err := db.Query("SELECT bookings.id, bookings.user_id, bookings.name, bookings.surname, bookings.email, bookings.phone, bookings.service, bookings.start_time, bookings.end_time FROM bookings LEFT JOIN users ON bookings.user_id=users.id")
+	rows, err := db.Query("SELECT bookings.id, bookings.user_id, bookings.stylist_id, bookings.name, bookings.surname, bookings.email, bookings.phone, bookings.service, bookings.start_time, bookings.end_time FROM bookings LEFT JOIN users ON bookings.user_id=users.id")
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to fetch bookings: %v", err), http.StatusInternalServerError)
 		return
@@ -165,37 +238,18 @@ func getBookingsHandler(w http.ResponseWriter, r *http.Request) {
 	var bookings []map[string]string
 	for rows.Next() {
 		var booking Booking
-		var userId sql.NullInt64
-		err := rows.Scan(&booking.Id, &userId, &booking.Name, &booking.Surname, &booking.Email, &booking.Phone, &booking.Service, &booking.StartTime, &booking.EndTime)
+		var userId, stylistId sql.NullInt64
+		var phone sql.NullString
+		err := rows.Scan(&booking.Id, &userId, &stylistId, &booking.Name, &booking.Surname, &booking.Email, &phone, &booking.Service, &booking.StartTime, &booking.EndTime)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to scan booking: %v", err), http.StatusInternalServerError)
 			return
 		}
+		booking.UserId = int(userId.Int64)
+		booking.StylistId = int(stylistId.Int64)
+		booking.Phone = phone.String
 
-		if userId.Valid && loggedIn && userId.Int64 == int64(id) {
-			booking.UserId = int(userId.Int64)
-		} else if isAdmin {
-			// Do nothing
-		} else {
-			booking.UserId = 0
-			booking.Name = "Taken"
-			booking.Surname = ""
-			booking.Email = "Hidden"
-			booking.Phone = "Hidden"
-			booking.Service = 0
-		}
-
-		bookings = append(bookings, map[string]string{
-			"id":         fmt.Sprintf("%d", booking.Id),
-			"name":       booking.Name,
-			"surname":    booking.Surname,
-			"email":      booking.Email,
-			"phone":      booking.Phone,
-			"service":    fmt.Sprintf("%d", booking.Service),
-			"start_time": booking.StartTime,
-			"end_time":   booking.EndTime,
-			"user_id":    fmt.Sprintf("%d", booking.UserId),
-		})
+		bookings = append(bookings, bookingView(caller, booking))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -207,34 +261,50 @@ func editBookingHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	apiKey := r.Header.Get("Authorization")
-	if apiKey != "" {
-		if valid, _ := validateAPIKey(apiKey); !valid {
-			http.Error(w, "Invalid API key", http.StatusUnauthorized)
-			return
-		}
+	caller := currentPrincipal(r)
+
+	var b Booking
+	err := json.NewDecoder(r.Body).Decode(&b)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
 	}
-	isAdmin, err := validateAdmin(apiKey)
+	allowed, err := canManageBooking(caller, b.Id)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to validate admin: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to check permissions: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if !isAdmin {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !allowed {
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
+	if !caller.Can(PermManageBookings) {
+		// Stylists cannot hand their bookings over to someone else.
+		b.StylistId = caller.UserId
+	}
+	if b.Service == 0 {
+		b.Service = 1
+	}
 
-	var b Booking
-	err = json.NewDecoder(r.Body).Decode(&b)
+	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Failed to update booking: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if b.Service == 0 {
-		b.Service = 1
+	defer tx.Rollback()
+
+	var before Booking
+	err = scanBooking(tx.QueryRow("SELECT "+bookingColumns+" FROM bookings WHERE id = $1 FOR UPDATE", b.Id), &before)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch booking: %v", err), http.StatusInternalServerError)
+		return
 	}
-	_, err = db.Exec(
-		"UPDATE bookings SET name = $1, surname = $2, email = $3, phone = $4, service = $5, start_time = $6, end_time = $7 WHERE id = $8 ",
+	err = scanBooking(tx.QueryRow(
+		"UPDATE bookings SET name = $1, surname = $2, email = $3, phone = $4, service = $5, start_time = $6, end_time = $7, stylist_id = $8 WHERE id = $9 RETURNING "+bookingColumns,
 		b.Name,
 		b.Surname,
 		b.Email,
@@ -242,12 +312,37 @@ func editBookingHandler(w http.ResponseWriter, r *http.Request) {
 		b.Service,
 		b.StartTime,
 		b.EndTime,
+		sql.NullInt64{Int64: int64(b.StylistId), Valid: b.StylistId != 0},
 		b.Id,
-	)
+	), &b)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to update booking: %v", err), http.StatusInternalServerError)
 		return
 	}
+	rescheduled := b.StartTime != before.StartTime || b.EndTime != before.EndTime
+	if err := recordChange(tx, caller.UserId, "booking.updated", "booking", b.Id, clientIP(r), before, b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := publishBookingEvent(tx, EventBookingUpdated, b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rescheduled {
+		// Reminders are due again relative to the new time.
+		if _, err := tx.Exec("DELETE FROM booking_reminders WHERE booking_id = $1", b.Id); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to reset reminders: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := queueBookingSMS(tx, b, "booking_changed", CategoryConfirmations); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update booking: %v", err), http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -257,37 +352,61 @@ func deleteBookingHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	apiKey := r.Header.Get("Authorization")
-	if apiKey != "" {
-		if valid, _ := validateAPIKey(apiKey); !valid {
-			http.Error(w, "Invalid API key", http.StatusUnauthorized)
-			return
-		}
+
+	var b Booking
+	err := json.NewDecoder(r.Body).Decode(&b)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
 	}
-	isAdmin, err := validateAdmin(apiKey)
+	allowed, err := canManageBooking(currentPrincipal(r), b.Id)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to validate admin: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to check permissions: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if !isAdmin {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !allowed {
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	var b Booking
-	err = json.NewDecoder(r.Body).Decode(&b)
+	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Failed to delete booking: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var upcoming bool
+	err = tx.QueryRow(
+		"DELETE FROM bookings WHERE id = $1 RETURNING COALESCE(user_id, 0), COALESCE(created_by, 0), COALESCE(stylist_id, 0), name, surname, email, COALESCE(phone, ''), COALESCE(service, 1), start_time, end_time, COALESCE(language, ''), start_time > NOW() AT TIME ZONE $2",
+		b.Id, salonTimezone(),
+	).Scan(&b.UserId, &b.CreatedBy, &b.StylistId, &b.Name, &b.Surname, &b.Email, &b.Phone, &b.Service, &b.StartTime, &b.EndTime, &b.Language, &upcoming)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Booking not found", http.StatusNotFound)
 		return
 	}
-	_, err = db.Exec(
-		"DELETE FROM bookings WHERE id = $1",
-		b.Id,
-	)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to delete booking: %v", err), http.StatusInternalServerError)
 		return
 	}
+	if err := publishBookingEvent(tx, EventBookingCancelled, b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordChange(tx, currentPrincipal(r).UserId, "booking.deleted", "booking", b.Id, clientIP(r), b, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if upcoming {
+		if err := queueBookingSMS(tx, b, "booking_cancelled", CategoryConfirmations); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete booking: %v", err), http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -303,12 +422,32 @@ func registerUserHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	if u.Language != "" && !isValidLanguage(u.Language) {
+		http.Error(w, "Unsupported language", http.StatusBadRequest)
+		return
+	}
 
 	valid, _ := validateUserExistence(u.Email)
 	if valid {
 		http.Error(w, "User already exists", http.StatusConflict)
 		return
 	}
+	// Someone may have signed up with this address without verifying it.
+	// Only the owner of the inbox can finish that registration, so they get a
+	// new link instead of a second account replacing the first.
+	var pendingId int
+	err = db.QueryRow("SELECT id FROM users WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NULL", u.Email).Scan(&pendingId)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Failed to register user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		if err := sendEmailVerification(pendingId, u.Email); err != nil {
+			log.Printf("Failed to send verification email to %s: %v", u.Email, err)
+		}
+		http.Error(w, "This address is already waiting for verification, check your inbox for a new link", http.StatusConflict)
+		return
+	}
 
 	encryptedPassword, err := encryptPassword(u.Password)
 	if err != nil {
@@ -322,17 +461,100 @@ func registerUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = db.Exec("INSERT INTO users (name, surname, email, password, api_key) VALUES ($1, $2, $3, $4, $5)", u.Name, u.Surname, u.Email, encryptedPassword, apiKey)
+	err = db.QueryRow(
+		"INSERT INTO users (name, surname, email, password, api_key, language) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		u.Name, u.Surname, u.Email, encryptedPassword, apiKey, sql.NullString{String: u.Language, Valid: u.Language != ""},
+	).Scan(&u.Id)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to register user: %v", err), http.StatusInternalServerError)
 		return
 	}
+	recordAudit(u.Id, "user.registered", "user", u.Id, clientIP(r), map[string]interface{}{"email": u.Email})
+
+	if err := sendEmailVerification(u.Id, u.Email); err != nil {
+		log.Printf("Failed to send verification email to %s: %v", u.Email, err)
+	}
 
 	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintln(w, "User registered")
+	fmt.Fprintln(w, "User registered, check your inbox to verify your email address")
 }
 
-func loginUserHandler(w http.ResponseWriter, r *http.Request) {
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+
+	userId, err := consumeEmailToken(db, token, "verify_email")
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to validate token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to verify email: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Integrations only hear about accounts once the address is proven, and
+	// only the first time, in case an older link is opened as well.
+	var email string
+	var justVerified bool
+	var u User
+	err = tx.QueryRow(`
+        UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW())
+        FROM (SELECT id AS old_id, email_verified_at IS NULL AS unverified FROM users WHERE id = $1 FOR UPDATE) old
+        WHERE users.id = old.old_id
+        RETURNING old.unverified, name, COALESCE(surname, ''), email, COALESCE(language, '')`,
+		userId,
+	).Scan(&justVerified, &u.Name, &u.Surname, &email, &u.Language)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to verify email: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if justVerified {
+		registered := RegisteredUser{Id: userId, Name: u.Name, Surname: u.Surname, Email: email, Role: RoleCustomer, Language: u.Language, Source: "signup"}
+		if err := queueWebhookEvent(tx, EventUserRegistered, registered); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to verify email: %v", err), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(userId, "user.email_verified", "user", userId, clientIP(r), nil)
+
+	// Now that the address is proven, offer to link bookings made as a guest.
+	guestBookings, err := countGuestBookings(email)
+	if err != nil {
+		log.Printf("Failed to look up guest bookings for %s: %v", email, err)
+	} else if guestBookings > 0 {
+		if err := offerGuestBookingClaim(userId, email, guestBookings); err != nil {
+			log.Printf("Failed to offer guest booking claim to %s: %v", email, err)
+		} else {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "Email verified. We found %d earlier booking(s) made with this address, check your inbox to link them to your account\n", guestBookings)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Email verified, you can now log in")
+}
+
+func resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
@@ -340,61 +562,329 @@ func loginUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	var u User
 	err := json.NewDecoder(r.Body).Decode(&u)
-	if err != nil {
+	if err != nil || u.Email == "" {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
 
-	var encryptedPassword string
-	err = db.QueryRow("SELECT password FROM users WHERE email = $1", u.Email).Scan(&encryptedPassword)
+	go func(email string) {
+		var userId int
+		err := db.QueryRow("SELECT id FROM users WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NULL", email).Scan(&userId)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Failed to look up user for verification: %v", err)
+			}
+			return
+		}
+		if err := sendEmailVerification(userId, email); err != nil {
+			log.Printf("Failed to send verification email to %s: %v", email, err)
+		}
+	}(u.Email)
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "If the address is waiting for verification, a new link has been sent")
+}
+
+var claimBookingsPage = template.Must(template.New("claim").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Salon}}</title></head>
+<body style="font-family: Arial, Helvetica, sans-serif; text-align: center; padding: 48px;">
+{{if .Done}}<p>Połączono rezerwacje z kontem: {{.Count}}. / {{.Count}} booking(s) linked to your account.</p>
+{{else}}<form method="post">
+<p>Połączyć wcześniejsze rezerwacje z tym kontem? / Link your earlier bookings to this account?</p>
+<button type="submit">Połącz / Link</button>
+</form>{{end}}
+</body>
+</html>
+`))
+
+// claimGuestBookingsHandler links bookings made as a guest to the account.
+// Like unsubscribeHandler, GET only shows a button so link scanners don't
+// use up the token; the bookings are claimed on POST.
+func claimGuestBookingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		var valid bool
+		err := db.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM email_tokens WHERE token_hash = $1 AND purpose = 'claim_bookings' AND used_at IS NULL AND expires_at > NOW())",
+			hashToken(token),
+		).Scan(&valid)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to validate token: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		claimBookingsPage.Execute(w, map[string]interface{}{"Salon": salonName(), "Done": false})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to claim bookings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	userId, err := consumeEmailToken(tx, token, "claim_bookings")
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, "User not found", http.StatusUnauthorized)
+			http.Error(w, "Invalid or expired link", http.StatusBadRequest)
 			return
 		}
-		http.Error(w, fmt.Sprintf("Failed to fetch user: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to validate token: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	err = decryptPassword(encryptedPassword, u.Password)
+	var claimed []int
+	err = tx.QueryRow(
+		"WITH claimed AS (UPDATE bookings SET user_id = users.id FROM users WHERE users.id = $1 AND LOWER(bookings.email) = LOWER(users.email) AND bookings.user_id IS NULL RETURNING bookings.id) SELECT COALESCE(array_agg(id ORDER BY id), '{}') FROM claimed",
+		userId,
+	).Scan(pq.Array(&claimed))
 	if err != nil {
-		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		http.Error(w, fmt.Sprintf("Failed to claim bookings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(claimed) > 0 {
+		err := writeAudit(tx, userId, "booking.claimed", "user", userId, clientIP(r), map[string]interface{}{"booking_ids": claimed}, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to claim bookings: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	var apiKey string
-	err = db.QueryRow("SELECT api_key FROM users WHERE email = $1", u.Email).Scan(&apiKey)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	claimBookingsPage.Execute(w, map[string]interface{}{"Salon": salonName(), "Done": true, "Count": len(claimed)})
+}
+
+func loginUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Email        string `json:"email"`
+		Password     string `json:"password"`
+		TOTPCode     string `json:"totp_code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	wait, err := loginRetryAfter(body.Email, ip)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to fetch API key: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to check login attempts: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many login attempts, try again later", http.StatusTooManyRequests)
 		return
 	}
+
+	// Unknown users and wrong passwords get the same answer, and an unknown
+	// user is still checked against a hash so both take as long.
+	var u User
+	encryptedPassword := dummyPasswordHash
+	var verified, totpEnabled, disabled bool
+	err = db.QueryRow("SELECT id, role, password, email_verified_at IS NOT NULL, totp_enabled, disabled_at IS NOT NULL FROM users WHERE LOWER(email) = LOWER($1)", body.Email).Scan(&u.Id, &u.Role, &encryptedPassword, &verified, &totpEnabled, &disabled)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Failed to fetch user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = decryptPassword(encryptedPassword, body.Password)
+	if err != nil || u.Id == 0 {
+		recordLoginAttempt(body.Email, ip, false)
+		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+		return
+	}
+
+	if totpEnabled {
+		var valid bool
+		switch {
+		case body.TOTPCode != "":
+			valid, err = verifyTOTP(u.Id, body.TOTPCode)
+		case body.RecoveryCode != "":
+			valid, err = useRecoveryCode(u.Id, body.RecoveryCode)
+			if valid {
+				recordAudit(u.Id, "2fa.recovery_code_used", "user", u.Id, ip, nil)
+			}
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":         "Two-factor code required",
+				"totp_required": true,
+			})
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to verify two-factor code: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			recordLoginAttempt(body.Email, ip, false)
+			http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+			return
+		}
+	}
+	recordLoginAttempt(body.Email, ip, true)
+	if !verified {
+		http.Error(w, "Email not verified, check your inbox for the verification link", http.StatusForbidden)
+		return
+	}
+	if disabled {
+		http.Error(w, "This account has been disabled", http.StatusForbidden)
+		return
+	}
+
+	tokens, err := createSession(u.Id, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if u.Role != RoleCustomer && !totpEnabled {
+		tokens.TOTPEnrollmentRequired, err = needsTOTPEnrollment(u.Id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"api_key": apiKey})
+	json.NewEncoder(w).Encode(tokens)
 }
 
-func checkUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	apiKey := r.Header.Get("Authorization")
-	if apiKey != "" {
-		if valid, _ := validateAPIKey(apiKey); !valid {
-			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+
+	var u User
+	err := json.NewDecoder(r.Body).Decode(&u)
+	if err != nil || u.Email == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	// The answer and its timing must not depend on whether the address is
+	// registered, so the lookup and the email happen in the background.
+	go func(email string) {
+		var userId int
+		err := db.QueryRow("SELECT id FROM users WHERE LOWER(email) = LOWER($1)", email).Scan(&userId)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Failed to look up user for password reset: %v", err)
+			}
 			return
 		}
+		if err := sendPasswordReset(userId, email); err != nil {
+			log.Printf("Failed to send password reset to %s: %v", email, err)
+		}
+	}(u.Email)
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "If the address is registered, a reset link has been sent")
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
 	}
-	isAdmin, err := validateAdmin(apiKey)
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Token == "" || body.Password == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	encryptedPassword, err := encryptPassword(body.Password)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encrypt password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update password: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	userId, err := consumeEmailToken(tx, body.Token, "password_reset")
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to validate token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("UPDATE users SET password = $1 WHERE id = $2", encryptedPassword, userId)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to validate admin: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to update password: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := revokeAllCredentials(tx, userId, 0); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to revoke credentials: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := writeAudit(tx, userId, "user.password_reset", "user", userId, clientIP(r), nil, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if !isAdmin {
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Password changed, please log in again")
+}
+
+func checkUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caller := currentPrincipal(r)
+	if !caller.IsStaff() {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"role":        caller.Role,
+		"permissions": caller.Permissions(),
+	})
 }
 
 func getUserInfoHandler(w http.ResponseWriter, r *http.Request) {
@@ -402,15 +892,8 @@ func getUserInfoHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	apiKey := r.Header.Get("Authorization")
-	if apiKey != "" {
-		if valid, _ := validateAPIKey(apiKey); !valid {
-			http.Error(w, "Invalid API key", http.StatusUnauthorized)
-			return
-		}
-	}
 	var u User
-	err := db.QueryRow("SELECT name, surname, email FROM users WHERE api_key = $1", apiKey).Scan(&u.Name, &u.Surname, &u.Email)
+	err := db.QueryRow("SELECT name, surname, email, role, COALESCE(language, '') FROM users WHERE id = $1", currentPrincipal(r).UserId).Scan(&u.Name, &u.Surname, &u.Email, &u.Role, &u.Language)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to fetch user info: %v", err), http.StatusInternalServerError)
 		return
@@ -452,6 +935,162 @@ func getServicesHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(services)
 }
 
+func updateServiceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var service Service
+	err := json.NewDecoder(r.Body).Decode(&service)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update service: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	before := Service{Id: service.Id}
+	err = tx.QueryRow(
+		"SELECT name, COALESCE(description, ''), COALESCE(price::text, ''), COALESCE(duration::text, '') FROM services WHERE id = $1 FOR UPDATE",
+		service.Id,
+	).Scan(&before.Name, &before.Description, &before.Price, &before.Duration)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Service not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch service: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = tx.QueryRow(
+		"UPDATE services SET name = $1, description = $2, price = $3, duration = $4 WHERE id = $5 RETURNING COALESCE(price::text, ''), COALESCE(duration::text, '')",
+		service.Name,
+		service.Description,
+		service.Price,
+		service.Duration,
+		service.Id,
+	).Scan(&service.Price, &service.Duration)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update service: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := recordChange(tx, currentPrincipal(r).UserId, "service.updated", "service", service.Id, clientIP(r), before, service); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update service: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func setUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var u User
+	err := json.NewDecoder(r.Body).Decode(&u)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !isValidRole(u.Role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	if u.Id == currentPrincipal(r).UserId && u.Role != RoleOwner {
+		http.Error(w, "You cannot demote yourself", http.StatusConflict)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update role: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var oldRole string
+	err = tx.QueryRow(
+		"UPDATE users SET role = $1 FROM (SELECT id, role FROM users WHERE id = $2 FOR UPDATE) AS old WHERE users.id = old.id RETURNING old.role",
+		u.Role, u.Id,
+	).Scan(&oldRole)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update role: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if oldRole != u.Role {
+		err = recordChange(tx, currentPrincipal(r).UserId, "user.role_changed", "user", u.Id, clientIP(r), map[string]string{"role": oldRole}, map[string]string{"role": u.Role})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update role: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func searchCustomersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Registered users come first, followed by guests known only from their
+	// bookings. Guests have user_id 0.
+	pattern := containsPattern(r.URL.Query().Get("q"))
+	rows, err := db.Query(`
+        SELECT id, name, COALESCE(surname, ''), email, '' FROM users
+        WHERE email_verified_at IS NOT NULL AND (name ILIKE $1 OR surname ILIKE $1 OR email ILIKE $1)
+        UNION ALL
+        SELECT DISTINCT ON (LOWER(email)) 0, name, surname, email, COALESCE(phone, '') FROM bookings
+        WHERE user_id IS NULL
+            AND (name ILIKE $1 OR surname ILIKE $1 OR email ILIKE $1)
+            AND NOT EXISTS (SELECT 1 FROM users WHERE LOWER(users.email) = LOWER(bookings.email) AND users.email_verified_at IS NOT NULL)
+        LIMIT 50
+    `, pattern)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to search customers: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var customers []map[string]string
+	for rows.Next() {
+		var id int
+		var name, surname, email, phone string
+		err := rows.Scan(&id, &name, &surname, &email, &phone)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan customer: %v", err), http.StatusInternalServerError)
+			return
+		}
+		customers = append(customers, map[string]string{
+			"user_id": fmt.Sprintf("%d", id),
+			"name":    name,
+			"surname": surname,
+			"email":   email,
+			"phone":   phone,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customers)
+}
+
 // func sendTestEmailHandler(w http.ResponseWriter, r *http.Request) {
 // 	to := "sample@example.com"
 // 	subject := "Test Email"
@@ -477,7 +1116,7 @@ func getServicesHandler(w http.ResponseWriter, r *http.Request) {
 // 	err := smtp.SendMail(addr, auth, smtpUser, []string{to}, msg)
 // 	if err != nil {
 // 		http.Error(w, "Failed to send email: "+err.Error(), http.StatusInternalServerError)
-// 		log.Printf("SMTP error: %v", err)
+// 		log.Printf("Mail error: %v", err)
 // 		return
 // 	}
 
@@ -508,29 +1147,13 @@ func sendEmailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	smtpHost := os.Getenv("SMTP_HOST")
-	smtpPort := os.Getenv("SMTP_PORT")
-	smtpUser := os.Getenv("SMTP_USER")
-	smtpPass := os.Getenv("SMTP_PASS")
-
-	auth := smtp.PlainAuth("", smtpUser, smtpPass, smtpHost)
-
-	msg := []byte("From: " + smtpUser + "\r\n" +
-		"To: " + to + "\r\n" +
-		"Subject: " + subject + "\r\n" +
-		"Content-Type: text/plain; charset=\"utf-8\"\r\n" +
-		"\r\n" +
-		body + "\r\n")
-
-	addr := smtpHost + ":" + smtpPort
-	log.Printf("Sending email to %s via %s\n", to, addr)
-
-	err = smtp.SendMail(addr, auth, smtpUser, []string{to}, msg)
+	err = sendEmail(Message{To: to, Subject: subject, Body: body})
 	if err != nil {
 		http.Error(w, "Failed to send email: "+err.Error(), http.StatusInternalServerError)
-		log.Printf("SMTP error: %v", err)
+		log.Printf("Mail error: %v", err)
 		return
 	}
+	recordAudit(currentPrincipal(r).UserId, "mail.sent", "email", 0, clientIP(r), map[string]interface{}{"to": to, "subject": subject})
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Email sent"))
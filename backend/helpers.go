@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -24,15 +25,6 @@ func generateAPIKey() (string, error) {
 	return hex.EncodeToString(key), nil
 }
 
-func validateAPIKey(apiKey string) (bool, error) {
-	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM users WHERE api_key = $1", apiKey).Scan(&count)
-	if err != nil {
-		return false, fmt.Errorf("failed to validate API key: %v", err)
-	}
-	return count > 0, nil
-}
-
 func encryptPassword(password string) (string, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -49,9 +41,13 @@ func decryptPassword(encryptedPassword, password string) error {
 	return nil
 }
 
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 func validateUserExistence(email string) (bool, error) {
 	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)", email).Scan(&exists)
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NOT NULL)", email).Scan(&exists)
 	if err != nil {
 		return false, fmt.Errorf("failed to check user existence: %v", err)
 	}
@@ -84,7 +80,7 @@ func createAdminUser(email, password string) {
 		if err != nil {
 			panic(err)
 		}
-		_, err = db.Exec(fmt.Sprintf("INSERT INTO users (name, surname, email, password, api_key, is_admin) VALUES ('admin', 'admin', '%s', $1, $2, TRUE)", email), hashedPassword, apiKey)
+		_, err = db.Exec(fmt.Sprintf("INSERT INTO users (name, surname, email, password, api_key, role, email_verified_at) VALUES ('admin', 'admin', '%s', $1, $2, 'owner', NOW())", email), hashedPassword, apiKey)
 		if err != nil {
 			panic(err)
 		}
@@ -94,13 +90,58 @@ func createAdminUser(email, password string) {
 	}
 }
 
-func validateAdmin(apiKey string) (bool, error) {
-	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM users WHERE api_key = $1 AND is_admin = TRUE", apiKey).Scan(&count)
-	if err != nil {
-		return false, fmt.Errorf("failed to validate admin: %v", err)
+// canSeeBooking reports whether the caller may see the customer details of a
+// booking. Everyone else only sees that the slot is taken.
+func canSeeBooking(p *Principal, b *Booking) bool {
+	if p == nil {
+		return false
 	}
-	return count > 0, nil
+	if p.Can(PermViewAllBookings) {
+		return true
+	}
+	if b.UserId != 0 && b.UserId == p.UserId {
+		return true
+	}
+	return p.Can(PermManageOwnBookings) && b.StylistId != 0 && b.StylistId == p.UserId
+}
+
+// bookingColumns are the columns scanBooking reads, for SELECT and RETURNING.
+const bookingColumns = "id, COALESCE(user_id, 0), COALESCE(created_by, 0), COALESCE(stylist_id, 0), name, surname, email, COALESCE(phone, ''), COALESCE(service, 1), start_time, end_time, COALESCE(language, '')"
+
+func scanBooking(row *sql.Row, b *Booking) error {
+	return row.Scan(&b.Id, &b.UserId, &b.CreatedBy, &b.StylistId, &b.Name, &b.Surname, &b.Email, &b.Phone, &b.Service, &b.StartTime, &b.EndTime, &b.Language)
+}
+
+// bookingView is a booking as callers see it in the calendar, with the
+// customer hidden unless canSeeBooking allows it.
+func bookingView(caller *Principal, booking Booking) map[string]string {
+	if !canSeeBooking(caller, &booking) {
+		booking.UserId = 0
+		booking.Name = "Taken"
+		booking.Surname = ""
+		booking.Email = "Hidden"
+		booking.Phone = "Hidden"
+		booking.Service = 0
+	}
+
+	return map[string]string{
+		"id":         fmt.Sprintf("%d", booking.Id),
+		"name":       booking.Name,
+		"surname":    booking.Surname,
+		"email":      booking.Email,
+		"phone":      booking.Phone,
+		"service":    fmt.Sprintf("%d", booking.Service),
+		"start_time": booking.StartTime,
+		"end_time":   booking.EndTime,
+		"user_id":    fmt.Sprintf("%d", booking.UserId),
+		"stylist_id": fmt.Sprintf("%d", booking.StylistId),
+	}
+}
+
+// containsPattern matches text anywhere in an ILIKE comparison, with the
+// wildcards in text taken literally.
+func containsPattern(text string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text) + "%"
 }
 
 func isBookingConflict(startTime, endTime string) (bool, error) {
@@ -118,95 +159,242 @@ func isBookingConflict(startTime, endTime string) (bool, error) {
 	return count > 0, nil
 }
 
-func isEmailRegistered(email, apiKey string) (bool, error) {
-	if apiKey != "" {
-		var userEmail string
-		err := db.QueryRow("SELECT email FROM users WHERE api_key = $1", apiKey).Scan(&userEmail)
-		if err != nil {
-			return false, fmt.Errorf("failed to get user info: %v", err)
-		}
-		if userEmail == email {
-			return false, nil
-		}
+func isEmailRegistered(email string, caller *Principal) (bool, error) {
+	if caller != nil && strings.EqualFold(caller.Email, email) {
+		return false, nil
 	}
 	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)", email).Scan(&exists)
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NOT NULL)", email).Scan(&exists)
 	if err != nil {
 		return false, fmt.Errorf("failed to check if email is registered: %v", err)
 	}
 	return exists, nil
 }
 
-func notifyBookingCreated(name, surname, email, start_time, end_time string) error {
-	to := os.Getenv("ADMIN_EMAIL")
-	subject := fmt.Sprintf("New Booking Created: %s %s | %s - %s", name, surname, start_time, end_time)
-	body := fmt.Sprintf("A new booking has been created:\n\nName: %s %s\nEmail: %s\nStart Time: %s\nEnd Time: %s", name, surname, email, start_time, end_time)
-
-	payload := map[string]string{
-		"to":      to,
-		"subject": subject,
-		"body":    body,
+func sendEmail(msg Message) error {
+	if err := mailer.Send(msg); err != nil {
+		return err
 	}
 
-	jsonData, err := json.Marshal(payload)
+	// Kept so subject-access requests can include what we sent.
+	_, err := db.Exec("INSERT INTO sent_emails (recipient, subject, body) VALUES ($1, $2, $3)", msg.To, msg.Subject, msg.Body)
 	if err != nil {
-		return fmt.Errorf("failed to marshal email payload: %v", err)
+		log.Printf("Failed to record sent email: %v", err)
 	}
+	return nil
+}
 
-	req, err := http.NewRequest("POST", "http://localhost:5000/mail/send", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create email request: %v", err)
+// bookingEmailData collects what the booking templates show.
+func bookingEmailData(tx *sql.Tx, b Booking) (map[string]interface{}, error) {
+	var service Service
+	err := tx.QueryRow(
+		"SELECT name, COALESCE(description, ''), COALESCE(price::text, ''), COALESCE(duration::text, '') FROM services WHERE id = $1",
+		b.Service,
+	).Scan(&service.Name, &service.Description, &service.Price, &service.Duration)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to fetch service: %v", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	return map[string]interface{}{"Booking": b, "Service": service}, nil
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+func confirmBookingCreated(tx *sql.Tx, b Booking) error {
+	data, err := bookingEmailData(tx, b)
 	if err != nil {
-		return fmt.Errorf("failed to send email: %v", err)
+		return err
+	}
+	if err := queueNotificationEmail(tx, b.UserId, b.Email, "booking_confirmation", b.Language, CategoryConfirmations, data); err != nil {
+		return err
 	}
-	defer resp.Body.Close()
+	return queueBookingSMS(tx, b, "booking_confirmation", CategoryConfirmations)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("email service returned status %d: %s", resp.StatusCode, string(respBody))
+// appURL is the public address of the frontend, used to build links in emails.
+func appURL() string {
+	if url := os.Getenv("APP_URL"); url != "" {
+		return strings.TrimRight(url, "/")
 	}
+	return "http://localhost:3000"
+}
 
-	return nil
+// salonTimezone is the IANA zone of the salon. Booking times are stored as
+// the salon's wall-clock time, so jobs compare them with
+// NOW() AT TIME ZONE salonTimezone() rather than the database's own clock.
+func salonTimezone() string {
+	if tz := os.Getenv("SALON_TIMEZONE"); tz != "" {
+		return tz
+	}
+	return "Europe/Warsaw"
 }
 
-func confirmBookingCreated(name, surname, email, start_time, end_time string) error {
-	to := email
-	subject := "Your booking was created"
-	body := fmt.Sprintf("Your booking was created:\n\nName: %s %s\nEmail: %s\nStart Time: %s\nEnd Time: %s", name, surname, email, start_time, end_time)
+// isTrustedProxy reports whether ip belongs to TRUSTED_PROXIES, a comma
+// separated list of addresses or CIDR ranges of the reverse proxies in front
+// of the backend.
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if proxy := net.ParseIP(entry); proxy != nil && proxy.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-	payload := map[string]string{
-		"to":      to,
-		"subject": subject,
-		"body":    body,
+// clientIP returns the address of the caller. X-Forwarded-For is only read
+// when the request comes from a trusted proxy, since anyone can send the
+// header, and the address closest to us that isn't a proxy wins.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(net.ParseIP(host)) {
+		return host
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		host = hop
+		if !isTrustedProxy(ip) {
+			break
+		}
 	}
+	return host
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-	jsonData, err := json.Marshal(payload)
+// createEmailToken stores a single-use token for the given purpose and returns
+// the plain value. Only the hash is kept in the database.
+func createEmailToken(q queryer, userId int, purpose string, ttl time.Duration) (string, error) {
+	token, err := generateAPIKey()
 	if err != nil {
-		return fmt.Errorf("failed to marshal email payload: %v", err)
+		return "", err
 	}
+	_, err = q.Exec(
+		"INSERT INTO email_tokens (user_id, purpose, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		userId,
+		purpose,
+		hashToken(token),
+		time.Now().Add(ttl),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to store email token: %v", err)
+	}
+	return token, nil
+}
+
+// consumeEmailToken marks a token as used and returns its owner. It returns
+// sql.ErrNoRows if the token is unknown, expired or already used.
+func consumeEmailToken(q queryer, token, purpose string) (int, error) {
+	var userId int
+	err := q.QueryRow(
+		"UPDATE email_tokens SET used_at = NOW() WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW() RETURNING user_id",
+		hashToken(token),
+		purpose,
+	).Scan(&userId)
+	return userId, err
+}
 
-	req, err := http.NewRequest("POST", "http://localhost:5000/mail/send", bytes.NewBuffer(jsonData))
+// revokeAllCredentials logs the user out everywhere: sessions and personal
+// access tokens are revoked and the legacy API key is replaced. The session
+// keepSessionId stays signed in; pass 0 to end them all.
+func revokeAllCredentials(q queryer, userId, keepSessionId int) error {
+	_, err := q.Exec("UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL", userId, keepSessionId)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %v", err)
+	}
+	_, err = q.Exec("UPDATE api_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userId)
+	if err != nil {
+		return fmt.Errorf("failed to revoke access tokens: %v", err)
+	}
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("UPDATE users SET api_key = $1 WHERE id = $2", apiKey, userId)
 	if err != nil {
-		return fmt.Errorf("failed to create email request: %v", err)
+		return fmt.Errorf("failed to rotate API key: %v", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	return nil
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+func sendPasswordReset(userId int, email string) error {
+	// Only the most recent link should work.
+	_, err := db.Exec("UPDATE email_tokens SET used_at = NOW() WHERE user_id = $1 AND purpose = 'password_reset' AND used_at IS NULL", userId)
+	if err != nil {
+		return fmt.Errorf("failed to invalidate reset tokens: %v", err)
+	}
+	token, err := createEmailToken(db, userId, "password_reset", durationFromEnv("PASSWORD_RESET_TTL", time.Hour))
 	if err != nil {
-		return fmt.Errorf("failed to send email: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
+	return sendTemplatedEmail(email, "password_reset", userLanguage(userId), map[string]interface{}{
+		"Link": fmt.Sprintf("%s/reset-password?token=%s", appURL(), token),
+	})
+}
 
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("email service returned status %d: %s", resp.StatusCode, string(respBody))
+func sendEmailVerification(userId int, email string) error {
+	token, err := createEmailToken(db, userId, "verify_email", durationFromEnv("EMAIL_VERIFICATION_TTL", 48*time.Hour))
+	if err != nil {
+		return err
 	}
+	return sendTemplatedEmail(email, "verify_email", userLanguage(userId), map[string]interface{}{
+		"Link": fmt.Sprintf("%s/auth/verifyEmail?token=%s", appURL(), token),
+	})
+}
 
+// purgeUnverifiedAccounts removes registrations that were never confirmed so
+// they don't hold on to someone else's address.
+func purgeUnverifiedAccounts() error {
+	cutoff := time.Now().Add(-durationFromEnv("UNVERIFIED_ACCOUNT_TTL", 7*24*time.Hour))
+	res, err := db.Exec("DELETE FROM users WHERE email_verified_at IS NULL AND created_at < $1", cutoff)
+	if err != nil {
+		return fmt.Errorf("failed to purge unverified accounts: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Purged %d unverified account(s)", n)
+	}
 	return nil
 }
+
+func countGuestBookings(email string) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM bookings WHERE LOWER(email) = LOWER($1) AND user_id IS NULL", email).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count guest bookings: %v", err)
+	}
+	return count, nil
+}
+
+// offerGuestBookingClaim emails a link that attaches earlier guest bookings
+// made with this address to the new account. Following the link proves the
+// user owns the mailbox.
+func offerGuestBookingClaim(userId int, email string, count int) error {
+	token, err := createEmailToken(db, userId, "claim_bookings", 7*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	return sendTemplatedEmail(email, "claim_bookings", userLanguage(userId), map[string]interface{}{
+		"Count": count,
+		"Link":  fmt.Sprintf("%s/auth/claimBookings?token=%s", appURL(), token),
+	})
+}
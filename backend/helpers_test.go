@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+func TestBookingView(t *testing.T) {
+	booking := Booking{
+		Id:        7,
+		Name:      "Jan",
+		Surname:   "Kowalski",
+		Email:     "jan@example.com",
+		Phone:     "+48123456789",
+		Service:   2,
+		StartTime: "2025-05-01 12:00:00",
+		EndTime:   "2025-05-01 13:00:00",
+		UserId:    10,
+		StylistId: 20,
+	}
+
+	tests := []struct {
+		name       string
+		caller     *Principal
+		wantHidden bool
+	}{
+		{"anonymous", nil, true},
+		{"owner", &Principal{UserId: 1, Role: RoleOwner}, false},
+		{"receptionist", &Principal{UserId: 2, Role: RoleReceptionist}, false},
+		{"customer who booked", &Principal{UserId: 10, Role: RoleCustomer}, false},
+		{"another customer", &Principal{UserId: 11, Role: RoleCustomer}, true},
+		{"assigned stylist", &Principal{UserId: 20, Role: RoleStylist}, false},
+		{"another stylist", &Principal{UserId: 21, Role: RoleStylist}, true},
+		{"owner without two-factor", &Principal{UserId: 1, Role: RoleOwner, NeedsTOTP: true}, true},
+		{"owner token with bookings:read", &Principal{UserId: 1, Role: RoleOwner, TokenId: 3, Scopes: []string{ScopeBookingsRead}}, false},
+		{"owner token without bookings:read", &Principal{UserId: 1, Role: RoleOwner, TokenId: 3, Scopes: []string{ScopeBookingsWrite}}, true},
+		{"stylist token without bookings:write", &Principal{UserId: 20, Role: RoleStylist, TokenId: 4, Scopes: []string{ScopeBookingsRead}}, true},
+		{"customer token for own booking", &Principal{UserId: 10, Role: RoleCustomer, TokenId: 5}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			view := bookingView(tt.caller, booking)
+
+			// The slot itself is always visible.
+			for key, want := range map[string]string{
+				"id":         "7",
+				"start_time": booking.StartTime,
+				"end_time":   booking.EndTime,
+				"stylist_id": "20",
+			} {
+				if view[key] != want {
+					t.Errorf("%s = %q, want %q", key, view[key], want)
+				}
+			}
+
+			want := map[string]string{
+				"name": "Jan", "surname": "Kowalski", "email": "jan@example.com",
+				"phone": "+48123456789", "service": "2", "user_id": "10",
+			}
+			if tt.wantHidden {
+				want = map[string]string{
+					"name": "Taken", "surname": "", "email": "Hidden",
+					"phone": "Hidden", "service": "0", "user_id": "0",
+				}
+			}
+			for key, value := range want {
+				if view[key] != value {
+					t.Errorf("%s = %q, want %q", key, view[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestContainsPattern(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"", "%%"},
+		{"kowalski", "%kowalski%"},
+		{"100%", `%100\%%`},
+		{"jan_k", `%jan\_k%`},
+		{`a\b`, `%a\\b%`},
+		{`\%_`, `%\\\%\_%`},
+	}
+	for _, tt := range tests {
+		if got := containsPattern(tt.text); got != tt.want {
+			t.Errorf("containsPattern(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// startJob runs a maintenance task in the background, once right away and
+// then on every tick. Errors are logged and the job keeps going.
+func startJob(name string, interval time.Duration, run func() error) {
+	go func() {
+		for {
+			if err := run(); err != nil {
+				log.Printf("Job %q failed: %v", name, err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Booking changes are pushed to open calendars over Server-Sent Events.
+// Handlers send them with pg_notify in their transaction, so they go out only
+// after commit, and every replica LISTENs and forwards them to its own
+// clients. Each client gets the booking masked for its role, as in
+// /bookings/get.
+
+const (
+	bookingChangesChannel = "booking_changes"
+	liveHeartbeat         = 25 * time.Second
+	liveClientBuffer      = 32
+
+	// EventResync tells clients that changes may have been missed and the
+	// calendar should be fetched again.
+	EventResync = "resync"
+)
+
+type BookingChange struct {
+	Event   string  `json:"event"`
+	Booking Booking `json:"booking"`
+}
+
+var liveClients = struct {
+	sync.Mutex
+	chans map[chan BookingChange]bool
+}{chans: map[chan BookingChange]bool{}}
+
+func notifyBookingChange(q queryer, event string, b Booking) error {
+	payload, err := json.Marshal(BookingChange{Event: event, Booking: b})
+	if err != nil {
+		return fmt.Errorf("failed to encode booking change: %v", err)
+	}
+	if _, err := q.Exec("SELECT pg_notify($1, $2)", bookingChangesChannel, string(payload)); err != nil {
+		return fmt.Errorf("failed to publish booking change: %v", err)
+	}
+	return nil
+}
+
+func subscribeBookingChanges() chan BookingChange {
+	ch := make(chan BookingChange, liveClientBuffer)
+	liveClients.Lock()
+	liveClients.chans[ch] = true
+	liveClients.Unlock()
+	return ch
+}
+
+func unsubscribeBookingChanges(ch chan BookingChange) {
+	liveClients.Lock()
+	if liveClients.chans[ch] {
+		delete(liveClients.chans, ch)
+		close(ch)
+	}
+	liveClients.Unlock()
+}
+
+// broadcastBookingChange hands a change to every client on this replica.
+// Clients that fall behind are disconnected; EventSource reconnects and the
+// calendar is fetched again, which is better than silently missing a change.
+func broadcastBookingChange(change BookingChange) {
+	liveClients.Lock()
+	defer liveClients.Unlock()
+	for ch := range liveClients.chans {
+		select {
+		case ch <- change:
+		default:
+			delete(liveClients.chans, ch)
+			close(ch)
+		}
+	}
+}
+
+// listenBookingChanges forwards notifications from Postgres to the clients
+// connected to this replica. It runs for the lifetime of the process.
+func listenBookingChanges() {
+	listener := pq.NewListener(os.Getenv("DATABASE_URL"), time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Booking change listener: %v", err)
+		}
+	})
+	if err := listener.Listen(bookingChangesChannel); err != nil {
+		log.Printf("Failed to listen for booking changes: %v", err)
+	}
+
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n == nil {
+				// The connection was re-established and notifications may
+				// have been lost in between.
+				broadcastBookingChange(BookingChange{Event: EventResync})
+				continue
+			}
+			var change BookingChange
+			if err := json.Unmarshal([]byte(n.Extra), &change); err != nil {
+				log.Printf("Failed to decode booking change: %v", err)
+				continue
+			}
+			broadcastBookingChange(change)
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+		}
+	}
+}
+
+// withQueryToken lets clients that can't set headers, like the browser's
+// EventSource, send their access token as ?access_token=.
+func withQueryToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next(w, r)
+	}
+}
+
+// streamBookingsHandler sends booking.created, booking.updated and
+// booking.cancelled events until the client goes away. Credentials are
+// checked again on every heartbeat so a logout or revoked token ends the
+// stream.
+func streamBookingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	caller := currentPrincipal(r)
+
+	changes := subscribeBookingChanges()
+	defer unsubscribeBookingChanges(changes)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case change, open := <-changes:
+			if !open {
+				return
+			}
+			data := map[string]string{}
+			if change.Event != EventResync {
+				data = bookingView(caller, change.Booking)
+			}
+			payload, err := json.Marshal(data)
+			if err != nil {
+				log.Printf("Failed to encode booking change: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", change.Event, payload)
+			flusher.Flush()
+		case <-heartbeat.C:
+			if caller != nil {
+				p, err := authenticate(r)
+				if err != nil || p == nil {
+					return
+				}
+				caller = p
+			}
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
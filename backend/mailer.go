@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+	// HTML is optional; when set the message is sent as multipart with Body
+	// as the plain-text alternative.
+	HTML string
+	// UnsubscribeURL is set on mail people can opt out of and becomes a
+	// one-click List-Unsubscribe header (RFC 8058).
+	UnsubscribeURL string
+}
+
+// buildMessage encodes msg as a MIME message.
+func buildMessage(from string, msg Message) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("From: " + from + "\r\n")
+	buf.WriteString("To: " + msg.To + "\r\n")
+	buf.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	if msg.UnsubscribeURL != "" {
+		buf.WriteString("List-Unsubscribe: <" + msg.UnsubscribeURL + ">\r\n")
+		buf.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if msg.HTML == "" {
+		buf.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&buf, msg.Body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	buf.WriteString("Content-Type: multipart/alternative; boundary=\"" + mw.Boundary() + "\"\r\n\r\n")
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain", msg.Body},
+		{"text/html", msg.HTML},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=\"utf-8\""},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, content string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// Mailer delivers email. The backend talks to it directly instead of going
+// through an HTTP endpoint, and tests can swap in their own implementation.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// mailer is set up by main from MAILER; see newMailerFromEnv.
+var mailer Mailer = &LogMailer{Out: os.Stdout}
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	// Header values come from user input in places, so line breaks must not
+	// be able to inject extra headers.
+	for _, value := range []string{msg.To, msg.Subject, msg.UnsubscribeURL} {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid email header %q", value)
+		}
+	}
+	data, err := buildMessage(m.From, msg)
+	if err != nil {
+		return fmt.Errorf("failed to build email: %v", err)
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := m.Host + ":" + m.Port
+	log.Printf("Sending email to %s via %s\n", msg.To, addr)
+	if err := smtp.SendMail(addr, auth, m.From, []string{msg.To}, data); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
+
+// LogMailer prints messages instead of sending them, for development.
+type LogMailer struct {
+	Out io.Writer
+	mu  sync.Mutex
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.Out, "--- email to %s ---\nSubject: %s\n\n%s\n---\n", msg.To, msg.Subject, msg.Body)
+	return err
+}
+
+// newMailerFromEnv picks the implementation from MAILER ("smtp" or "log").
+// Without MAILER, SMTP is used when SMTP_HOST is set.
+func newMailerFromEnv() (Mailer, error) {
+	kind := os.Getenv("MAILER")
+	if kind == "" {
+		kind = "log"
+		if os.Getenv("SMTP_HOST") != "" {
+			kind = "smtp"
+		}
+	}
+
+	switch kind {
+	case "smtp":
+		m := &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USER"),
+			Password: os.Getenv("SMTP_PASS"),
+			From:     os.Getenv("SMTP_FROM"),
+		}
+		if m.Host == "" {
+			return nil, fmt.Errorf("MAILER is smtp but SMTP_HOST is not set")
+		}
+		if m.Port == "" {
+			m.Port = "587"
+		}
+		if m.From == "" {
+			m.From = m.Username
+		}
+		return m, nil
+	case "log":
+		return &LogMailer{Out: os.Stdout}, nil
+	}
+	return nil, fmt.Errorf("unknown MAILER %q", kind)
+}
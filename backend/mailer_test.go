@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestBuildMessage(t *testing.T) {
+	tests := []struct {
+		name            string
+		msg             Message
+		wantUnsubscribe string
+		wantParts       map[string]string
+	}{
+		{
+			name: "plain text",
+			msg:  Message{To: "jan@example.com", Subject: "Potwierdzenie wizyty", Body: "Do zobaczenia o 12:00"},
+			wantParts: map[string]string{
+				"text/plain": "Do zobaczenia o 12:00",
+			},
+		},
+		{
+			name:            "unsubscribe link",
+			msg:             Message{To: "jan@example.com", Subject: "Przypomnienie", Body: "Jutro o 9:00", UnsubscribeURL: "https://salon.example.com/unsubscribe?token=abc"},
+			wantUnsubscribe: "<https://salon.example.com/unsubscribe?token=abc>",
+			wantParts: map[string]string{
+				"text/plain": "Jutro o 9:00",
+			},
+		},
+		{
+			name: "html alternative",
+			msg:  Message{To: "jan@example.com", Subject: "Zażółć gęślą jaźń", Body: "Wizyta odwołana", HTML: "<p>Wizyta <b>odwołana</b></p>"},
+			wantParts: map[string]string{
+				"text/plain": "Wizyta odwołana",
+				"text/html":  "<p>Wizyta <b>odwołana</b></p>",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := buildMessage("Salon <salon@example.com>", tt.msg)
+			if err != nil {
+				t.Fatalf("buildMessage: %v", err)
+			}
+			m, err := mail.ReadMessage(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("ReadMessage: %v", err)
+			}
+
+			if got := m.Header.Get("From"); got != "Salon <salon@example.com>" {
+				t.Errorf("From = %q", got)
+			}
+			if got := m.Header.Get("To"); got != tt.msg.To {
+				t.Errorf("To = %q, want %q", got, tt.msg.To)
+			}
+			subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+			if err != nil || subject != tt.msg.Subject {
+				t.Errorf("Subject = %q (%v), want %q", subject, err, tt.msg.Subject)
+			}
+			if got := m.Header.Get("List-Unsubscribe"); got != tt.wantUnsubscribe {
+				t.Errorf("List-Unsubscribe = %q, want %q", got, tt.wantUnsubscribe)
+			}
+			wantPost := ""
+			if tt.wantUnsubscribe != "" {
+				wantPost = "List-Unsubscribe=One-Click"
+			}
+			if got := m.Header.Get("List-Unsubscribe-Post"); got != wantPost {
+				t.Errorf("List-Unsubscribe-Post = %q, want %q", got, wantPost)
+			}
+
+			got := readParts(t, m.Header.Get("Content-Type"), m.Body)
+			if len(got) != len(tt.wantParts) {
+				t.Fatalf("got parts %v, want %v", got, tt.wantParts)
+			}
+			for contentType, want := range tt.wantParts {
+				if got[contentType] != want {
+					t.Errorf("%s part = %q, want %q", contentType, got[contentType], want)
+				}
+			}
+		})
+	}
+}
+
+// readParts decodes a message body into its content by media type.
+func readParts(t *testing.T, contentType string, body io.Reader) map[string]string {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("ParseMediaType(%q): %v", contentType, err)
+	}
+	parts := map[string]string{}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		content, err := io.ReadAll(quotedprintable.NewReader(body))
+		if err != nil {
+			t.Fatalf("read body: %v", err)
+		}
+		parts[mediaType] = string(content)
+		return parts
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatalf("NextPart: %v", err)
+		}
+		// multipart.Reader decodes quoted-printable parts itself.
+		content, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[partType] = string(content)
+	}
+}
+
+func TestSMTPMailerRejectsHeaderInjection(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"recipient", Message{To: "jan@example.com\r\nBcc: all@example.com", Subject: "Hej"}},
+		{"subject", Message{To: "jan@example.com", Subject: "Hej\nBcc: all@example.com"}},
+		{"unsubscribe link", Message{To: "jan@example.com", Subject: "Hej", UnsubscribeURL: "https://example.com/\r\nBcc: all@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No host is configured, so getting past the check would fail
+			// differently.
+			m := &SMTPMailer{From: "salon@example.com"}
+			err := m.Send(tt.msg)
+			if err == nil || !strings.Contains(err.Error(), "invalid email header") {
+				t.Errorf("Send = %v, want an invalid header error", err)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -19,18 +20,50 @@ func main() {
 	defer db.Close()
 
 	waitForDbConnection()
+	mailer, err = newMailerFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	smsProvider, err = newSMSProviderFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	if len(os.Args) > 1 {
+		code := runCommand(os.Args[1:])
+		db.Close()
+		os.Exit(code)
+	}
 	createAdminUser(os.Getenv("ADMIN_EMAIL"), os.Getenv("ADMIN_PASSWORD"))
+	if err := seedNotificationRoutes(os.Getenv("ADMIN_EMAIL")); err != nil {
+		panic(err)
+	}
+
+	startJob("purge unverified accounts", time.Hour, purgeUnverifiedAccounts)
+	startJob("prune login attempts", time.Hour, pruneLoginAttempts)
+	startJob("prune OIDC states", time.Hour, pruneOIDCStates)
+	startJob("booking retention", 24*time.Hour, enforceRetention)
+	startJob("deliver email outbox", 10*time.Second, deliverOutbox)
+	startJob("prune email outbox", 24*time.Hour, pruneOutbox)
+	startJob("appointment reminders", time.Minute, sendReminders)
+	startJob("deliver SMS outbox", 10*time.Second, deliverSMSOutbox)
+	startJob("notification digests", 15*time.Minute, sendNotificationDigests)
+	startJob("prune notification digests", 24*time.Hour, pruneNotificationDigests)
+	startJob("schedule digests", time.Minute, sendScheduleDigests)
+	startJob("prune schedule digest runs", 24*time.Hour, pruneScheduleDigestRuns)
+	startJob("deliver webhooks", 10*time.Second, deliverWebhooks)
+	startJob("prune webhook deliveries", 24*time.Hour, pruneWebhookDeliveries)
+	go listenBookingChanges()
 
 	http.HandleFunc("/hello", helloHandler) //tester
 	/*
 		curl -X GET "http://localhost:5000/hello"
 	*/
 
-	http.HandleFunc("/bookings/create", createBookingHandler)
+	http.HandleFunc("/bookings/create", withScope(ScopeBookingsWrite, createBookingHandler))
 	/*
 		curl -X POST "http://localhost:5000/bookings/create" \
 		-H "Content-Type: application/json" \
-		-H "Authorization: API_KEY" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
 		-d '{
 			"name": "John",
 			"surname": "Doe",
@@ -40,6 +73,16 @@ func main() {
 			"start_time": "2025-05-01T09:00:00",
 			"end_time": "2025-05-01T10:00:00"
 		}'
+
+		Staff can book for an existing customer by passing their user ID
+		(or just their e-mail) and leaving the rest empty:
+		-d '{
+			"on_behalf_of": 2,
+			"phone": "123456789",
+			"service": 1,
+			"start_time": "2025-05-01T09:00:00",
+			"end_time": "2025-05-01T10:00:00"
+		}'
 	*/
 
 	http.HandleFunc("/bookings/createGuest", createBookingHandlerGuest)
@@ -55,17 +98,26 @@ func main() {
 		}'
 	*/
 
-	http.HandleFunc("/bookings/get", getBookingsHandler)
+	http.HandleFunc("/bookings/get", withScope(ScopeBookingsRead, getBookingsHandler))
 	/*
 		curl -X GET "http://localhost:5000/bookings/get" \
-		-H "Authorization: API_KEY"
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+
+	http.HandleFunc("/bookings/stream", withQueryToken(withScope(ScopeBookingsRead, streamBookingsHandler)))
+	/*
+		Server-Sent Events: booking.created, booking.updated, booking.cancelled with the
+		booking as in /bookings/get, and resync when the calendar should be fetched again.
+		EventSource can't send headers, so the token may also be passed as ?access_token=
+		curl -N "http://localhost:5000/bookings/stream" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
 	*/
 
-	http.HandleFunc("/bookings/update", editBookingHandler)
+	http.HandleFunc("/bookings/update", requirePermission(editBookingHandler, PermManageBookings, PermManageOwnBookings))
 	/*
 		curl -X POST "http://localhost:5000/bookings/update" \
 		-H "Content-Type: application/json" \
-		-H "Authorization: API_KEY" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
 		-d '{
 			"id": 1,
 			"name": "John",
@@ -78,21 +130,123 @@ func main() {
 		}'
 	*/
 
-	http.HandleFunc("/bookings/delete", deleteBookingHandler)
+	http.HandleFunc("/bookings/delete", requirePermission(deleteBookingHandler, PermManageBookings, PermManageOwnBookings))
 	/*
 		curl -X POST "http://localhost:5000/bookings/delete" \
 		-H "Content-Type: application/json" \
-		-H "Authorization: API_KEY" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
 		-d '{
 			"id": 1
 		}'
 	*/
 
+	http.HandleFunc("/bookings/customers", requirePermission(searchCustomersHandler, PermBookOnBehalf))
+	/*
+		curl -X GET "http://localhost:5000/bookings/customers?q=doe" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+
+	http.HandleFunc("/bookings/retention", requirePermission(retentionReportHandler, PermManageSettings))
+	/*
+		Dry run: bookings whose personal details the retention policy would anonymize
+		curl -X GET "http://localhost:5000/bookings/retention?months=24" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
 	http.HandleFunc("/bookings/servicesGet", getServicesHandler)
 	/*
 		curl -X GET "http://localhost:5000/bookings/servicesGet" \
 	*/
 
+	http.HandleFunc("/bookings/servicesUpdate", requirePermission(updateServiceHandler, PermManagePricing))
+	/*
+		curl -X POST "http://localhost:5000/bookings/servicesUpdate" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"id": 2,
+			"name": "Haircut",
+			"description": "A simple haircut",
+			"price": "25.00",
+			"duration": "30"
+		}'
+	*/
+
+	http.HandleFunc("/users", requirePermission(listUsersHandler, PermManageUsers))
+	/*
+		Filters: q (name or email), role, status (active, disabled, unverified), page, per_page
+		curl -X GET "http://localhost:5000/users?q=kowalski&role=customer&page=1&per_page=25" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/users/create", requirePermission(createUserHandler, PermManageUsers))
+	/*
+		The new user gets an email with a link to choose their password
+		curl -X POST "http://localhost:5000/users/create" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"name": "Anna",
+			"surname": "Nowak",
+			"email": "anna@example.com",
+			"role": "stylist"
+		}'
+	*/
+	http.HandleFunc("/users/disable", requirePermission(disableUserHandler, PermManageUsers))
+	/*
+		Blocks login and every key of the user, "disabled": false enables the account again
+		curl -X POST "http://localhost:5000/users/disable" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"id": 2,
+			"disabled": true
+		}'
+	*/
+	http.HandleFunc("/users/delete", requirePermission(deleteUserHandler, PermManageUsers))
+	/*
+		curl -X POST "http://localhost:5000/users/delete" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"id": 2
+		}'
+	*/
+	http.HandleFunc("/users/resetPassword", requirePermission(resetUserPasswordHandler, PermManageUsers))
+	/*
+		Emails the user a password reset link
+		curl -X POST "http://localhost:5000/users/resetPassword" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"id": 2
+		}'
+	*/
+	http.HandleFunc("/users/role", requirePermission(setUserRoleHandler, PermManageUsers))
+	/*
+		curl -X POST "http://localhost:5000/users/role" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"id": 2,
+			"role": "receptionist"
+		}'
+	*/
+
+	http.HandleFunc("/users/export", requirePermission(exportPersonalDataHandler, PermManageUsers))
+	/*
+		Works for guests without an account too, add &format=zip for an archive
+		curl -X GET "http://localhost:5000/users/export?email=jan@example.com" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/users/erase", requirePermission(erasePersonalDataHandler, PermManageUsers))
+	/*
+		Deletes the account, cancels upcoming bookings and anonymizes past ones
+		curl -X POST "http://localhost:5000/users/erase" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"email": "jan@example.com"
+		}'
+	*/
 	http.HandleFunc("/auth/register", registerUserHandler)
 	/*
 		curl -X POST "http://localhost:5000/auth/register" \
@@ -112,16 +266,242 @@ func main() {
 			"email": "johndoe@example.com",
 			"password": "password123"
 		}'
+
+		With two-factor authentication enabled add "totp_code": "123456"
+		or "recovery_code": "abcde-12345"
+	*/
+	http.HandleFunc("/auth/oidc/login", oidcLoginHandler)
+	/*
+		Open in the browser, redirects to the identity provider and back to
+		APP_URL with the session tokens in the URL fragment
+		http://localhost:3000/auth/oidc/login
+	*/
+	http.HandleFunc("/auth/oidc/link", requireLogin(oidcLinkHandler))
+	/*
+		Links the identity provider to an existing account. Open the returned
+		url in the browser to finish
+		curl -X POST "http://localhost:5000/auth/oidc/link" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"password": "password123"
+		}'
+	*/
+	http.HandleFunc("/auth/oidc/callback", oidcCallbackHandler)
+	http.HandleFunc("/auth/verifyEmail", verifyEmailHandler)
+	/*
+		curl -X GET "http://localhost:5000/auth/verifyEmail?token=TOKEN_FROM_EMAIL"
+	*/
+	http.HandleFunc("/auth/resendVerification", resendVerificationHandler)
+	/*
+		curl -X POST "http://localhost:5000/auth/resendVerification" \
+		-H "Content-Type: application/json" \
+		-d '{
+			"email": "johndoe@example.com"
+		}'
+	*/
+	http.HandleFunc("/auth/forgotPassword", forgotPasswordHandler)
+	/*
+		curl -X POST "http://localhost:5000/auth/forgotPassword" \
+		-H "Content-Type: application/json" \
+		-d '{
+			"email": "johndoe@example.com"
+		}'
+	*/
+	http.HandleFunc("/auth/resetPassword", resetPasswordHandler)
+	/*
+		curl -X POST "http://localhost:5000/auth/resetPassword" \
+		-H "Content-Type: application/json" \
+		-d '{
+			"token": "TOKEN_FROM_EMAIL",
+			"password": "newpassword123"
+		}'
+	*/
+	http.HandleFunc("/auth/refresh", refreshSessionHandler)
+	/*
+		curl -X POST "http://localhost:5000/auth/refresh" \
+		-H "Content-Type: application/json" \
+		-d '{
+			"refresh_token": "REFRESH_TOKEN"
+		}'
+	*/
+	http.HandleFunc("/auth/logout", requireLogin(logoutHandler))
+	/*
+		curl -X POST "http://localhost:5000/auth/logout" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/auth/logoutAll", requireLogin(logoutAllHandler))
+	/*
+		curl -X POST "http://localhost:5000/auth/logoutAll" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/auth/sessions", requireLogin(listSessionsHandler))
+	/*
+		curl -X GET "http://localhost:5000/auth/sessions" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/auth/sessions/revoke", requirePermission(revokeSessionsHandler, PermManageUsers))
+	/*
+		curl -X POST "http://localhost:5000/auth/sessions/revoke" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"user_id": 2
+		}'
+	*/
+	http.HandleFunc("/auth/apiKey", requireLogin(apiKeyHandler))
+	/*
+		Long-lived key for integrations, POST rotates it
+		curl -X GET "http://localhost:5000/auth/apiKey" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/auth/2fa/enroll", requireLogin(enrollTOTPHandler))
+	/*
+		Returns the secret and an otpauth:// URI to render as a QR code
+		curl -X POST "http://localhost:5000/auth/2fa/enroll" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/auth/2fa/confirm", requireLogin(confirmTOTPHandler))
+	/*
+		curl -X POST "http://localhost:5000/auth/2fa/confirm" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"code": "123456"
+		}'
+	*/
+	http.HandleFunc("/auth/2fa/disable", requireLogin(disableTOTPHandler))
+	/*
+		curl -X POST "http://localhost:5000/auth/2fa/disable" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"password": "password123",
+			"code": "123456"
+		}'
+	*/
+	http.HandleFunc("/auth/2fa/recoveryCodes", requireLogin(regenerateRecoveryCodesHandler))
+	/*
+		curl -X POST "http://localhost:5000/auth/2fa/recoveryCodes" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"code": "123456"
+		}'
+	*/
+	http.HandleFunc("/settings/2fa", requirePermission(staff2FAPolicyHandler, PermManageSettings))
+	/*
+		curl -X POST "http://localhost:5000/settings/2fa" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"require_staff_2fa": true
+		}'
+	*/
+	http.HandleFunc("/auth/tokens", requireLogin(listAccessTokensHandler))
+	/*
+		curl -X GET "http://localhost:5000/auth/tokens" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/auth/tokens/create", requireLogin(createAccessTokenHandler))
+	/*
+		Scopes: bookings:read, bookings:write, admin
+		curl -X POST "http://localhost:5000/auth/tokens/create" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"name": "Accounting sheet",
+			"scopes": ["bookings:read"],
+			"expires_at": "2026-12-31"
+		}'
+	*/
+	http.HandleFunc("/auth/tokens/revoke", requireLogin(revokeAccessTokenHandler))
+	/*
+		curl -X POST "http://localhost:5000/auth/tokens/revoke" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"id": 1
+		}'
+	*/
+	http.HandleFunc("/auth/claimBookings", claimGuestBookingsHandler)
+	/*
+		GET shows a confirmation page, POST links the bookings
+		curl -X POST "http://localhost:5000/auth/claimBookings?token=TOKEN_FROM_EMAIL"
+	*/
+	http.HandleFunc("/auth/profile", requireLogin(updateProfileHandler))
+	/*
+		Also updates the contact details on upcoming bookings
+		curl -X POST "http://localhost:5000/auth/profile" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"name": "Jan",
+			"surname": "Kowalski"
+		}'
+	*/
+	http.HandleFunc("/auth/digests", requireLogin(scheduleDigestsHandler))
+	/*
+		Daily schedule emails for staff. agenda: tomorrow's appointments assigned
+		to the caller, summary: today's bookings and revenue (owner, receptionist).
+		GET shows the settings, POST changes them; send_at defaults to SCHEDULE_DIGEST_TIME
+		curl -X POST "http://localhost:5000/auth/digests" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"agenda": {"enabled": true, "send_at": "20:30"}
+		}'
+	*/
+	http.HandleFunc("/auth/changePassword", requireLogin(changePasswordHandler))
+	/*
+		Logs out every other session, revokes personal access tokens and replaces the API key
+		curl -X POST "http://localhost:5000/auth/changePassword" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"current_password": "password123",
+			"new_password": "password456"
+		}'
+	*/
+	http.HandleFunc("/auth/changeEmail", requireLogin(changeEmailHandler))
+	/*
+		Sends a confirmation link to the new address, the old one stays until it is opened
+		curl -X POST "http://localhost:5000/auth/changeEmail" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"email": "new@example.com",
+			"password": "password123"
+		}'
+	*/
+	http.HandleFunc("/auth/confirmEmailChange", confirmEmailChangeHandler)
+	/*
+		curl -X GET "http://localhost:5000/auth/confirmEmailChange?token=TOKEN_FROM_EMAIL"
+	*/
+	http.HandleFunc("/auth/export", requireLogin(exportMyDataHandler))
+	/*
+		Everything stored about the caller, add ?format=zip for an archive
+		curl -X GET "http://localhost:5000/auth/export?format=zip" -o personal-data.zip \
+		-H "Authorization: Bearer ACCESS_TOKEN"
 	*/
-	http.HandleFunc("/auth/check", checkUserPermissionHandler)
+	http.HandleFunc("/auth/deleteAccount", requireLogin(deleteMyAccountHandler))
+	/*
+		curl -X POST "http://localhost:5000/auth/deleteAccount" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"password": "password123"
+		}'
+	*/
+	http.HandleFunc("/auth/check", requireLogin(checkUserPermissionHandler))
 	/*
 		curl -X GET "http://localhost:5000/auth/check" \
-		-H "Authorization: API_KEY"
+		-H "Authorization: Bearer ACCESS_TOKEN"
 	*/
-	http.HandleFunc("/auth/get", getUserInfoHandler)
+	http.HandleFunc("/auth/get", requireLogin(getUserInfoHandler))
 	/*
 		curl -X GET "http://localhost:5000/auth/get" \
-		-H "Authorization: API_KEY"
+		-H "Authorization: Bearer ACCESS_TOKEN"
 	*/
 
 	//http.HandleFunc("/mail/test", sendTestEmailHandler)
@@ -129,7 +509,166 @@ func main() {
 		curl -X POST "http://localhost:5000/mail/test"
 	*/
 
-	http.HandleFunc("/mail/send", sendEmailHandler)
+	http.HandleFunc("/settings/mail/outbox", requirePermission(listOutboxHandler, PermManageSettings))
+	/*
+		Queued notifications, status: dead (default), pending or sent
+		curl -X GET "http://localhost:5000/settings/mail/outbox?status=dead" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/settings/mail/outbox/retry", requirePermission(retryOutboxHandler, PermManageSettings))
+	/*
+		Queues a dead message again, without an id all dead messages are retried
+		curl -X POST "http://localhost:5000/settings/mail/outbox/retry" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"id": 1
+		}'
+	*/
+	http.HandleFunc("/settings/notifications", requirePermission(notificationRoutesHandler, PermManageSettings))
+	/*
+		GET lists who is notified of booking events, POST adds a route.
+		event: booking.created, booking.updated or booking.cancelled
+		target: stylist (assigned to the booking), email (with address) or role (with role)
+		delivery: instant (default) or digest (one email a day at NOTIFICATION_DIGEST_HOUR)
+		curl -X POST "http://localhost:5000/settings/notifications" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"event": "booking.cancelled",
+			"target": "role",
+			"role": "receptionist",
+			"delivery": "digest"
+		}'
+	*/
+	http.HandleFunc("/settings/notifications/delete", requirePermission(deleteNotificationRouteHandler, PermManageSettings))
+	/*
+		curl -X POST "http://localhost:5000/settings/notifications/delete" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"id": 1
+		}'
+	*/
+	http.HandleFunc("/notifications/preferences", withAuth(notificationPreferencesHandler))
+	/*
+		GET shows the preferences, POST changes the given ones. Logged in users
+		send their access token, guests the token from an unsubscribe link (?token=)
+		curl -X POST "http://localhost:5000/notifications/preferences" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"email": {"reminders": false, "marketing": true},
+			"sms": {"confirmations": false}
+		}'
+	*/
+	http.HandleFunc("/notifications/unsubscribe", unsubscribeHandler)
+	/*
+		Link from the email footer. GET shows a confirmation button, POST unsubscribes
+		(also used by mail clients for one-click List-Unsubscribe)
+		curl -X POST "http://localhost:5000/notifications/unsubscribe?token=TOKEN&category=reminders"
+	*/
+	http.HandleFunc("/sms", requirePermission(listSMSHandler, PermManageSettings))
+	/*
+		Recent text messages, optionally filtered by status: pending, sent, delivered, failed or dead
+		curl -X GET "http://localhost:5000/sms?status=failed" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/sms/costs", requirePermission(smsCostsHandler, PermManageSettings))
+	/*
+		Number of messages and their cost per month
+		curl -X GET "http://localhost:5000/sms/costs?months=6" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/sms/status", smsStatusHandler)
+	/*
+		Delivery report from the SMS gateway, authenticated with SMS_STATUS_TOKEN
+		curl -X POST "http://localhost:5000/sms/status?token=SMS_STATUS_TOKEN" \
+		-H "Content-Type: application/json" \
+		-d '{
+			"id": "abc123",
+			"status": "delivered",
+			"cost": 0.07
+		}'
+	*/
+	http.HandleFunc("/webhooks", requirePermission(webhooksHandler, PermManageSettings))
+	/*
+		GET lists webhooks, POST adds one. The response to POST contains the signing secret,
+		it is not shown again.
+		events: booking.created, booking.updated, booking.cancelled, user.registered
+		curl -X POST "http://localhost:5000/webhooks" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"url": "https://example.com/hooks/salon",
+			"events": ["booking.created", "booking.cancelled"],
+			"description": "CRM"
+		}'
+	*/
+	http.HandleFunc("/webhooks/update", requirePermission(updateWebhookHandler, PermManageSettings))
+	/*
+		curl -X POST "http://localhost:5000/webhooks/update" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"id": 1,
+			"active": false
+		}'
+	*/
+	http.HandleFunc("/webhooks/delete", requirePermission(deleteWebhookHandler, PermManageSettings))
+	/*
+		curl -X POST "http://localhost:5000/webhooks/delete" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"id": 1
+		}'
+	*/
+	http.HandleFunc("/webhooks/test", requirePermission(testWebhookHandler, PermManageSettings))
+	/*
+		Sends a ping event to the webhook
+		curl -X POST "http://localhost:5000/webhooks/test" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"id": 1
+		}'
+	*/
+	http.HandleFunc("/webhooks/deliveries", requirePermission(webhookDeliveriesHandler, PermManageSettings))
+	/*
+		Delivery log, optionally filtered by webhook and status: pending, delivered or dead
+		curl -X GET "http://localhost:5000/webhooks/deliveries?webhook_id=1&status=dead&page=1" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/webhooks/redeliver", requirePermission(redeliverWebhookHandler, PermManageSettings))
+	/*
+		Sends the payload of an earlier delivery again
+		curl -X POST "http://localhost:5000/webhooks/redeliver" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"id": 42
+		}'
+	*/
+	http.HandleFunc("/audit", requirePermission(auditLogHandler, PermViewAuditLog))
+	/*
+		Who changed what, newest first, 100 entries per page. Filters: actor_id, action,
+		entity, entity_id, ip, from and to (dates, inclusive)
+		curl -X GET "http://localhost:5000/audit?entity=booking&entity_id=12&from=2025-05-01&to=2025-05-31" \
+		-H "Authorization: Bearer ACCESS_TOKEN"
+	*/
+	http.HandleFunc("/mail/send", requirePermission(sendEmailHandler, PermManageSettings))
+	/*
+		Sends a test message through the configured mailer
+		curl -X POST "http://localhost:5000/mail/send" \
+		-H "Content-Type: application/json" \
+		-H "Authorization: Bearer ACCESS_TOKEN" \
+		-d '{
+			"to": "jan@example.com",
+			"subject": "Test",
+			"body": "Test message"
+		}'
+	*/
 
 	fmt.Println("Starting server on :5000")
 	if err := http.ListenAndServe(":5000", nil); err != nil {
@@ -1,15 +1,19 @@
 package main
 
 type Booking struct {
-	Id        int    `json:"id"`
-	Name      string `json:"name"`
-	Surname   string `json:"surname"`
-	Email     string `json:"email"`
-	Phone     string `json:"phone"`
-	Service   int16  `json:"service"`
-	StartTime string `json:"start_time"`
-	EndTime   string `json:"end_time"`
-	UserId    int    `json:"user_id"`
+	Id         int    `json:"id"`
+	Name       string `json:"name"`
+	Surname    string `json:"surname"`
+	Email      string `json:"email"`
+	Phone      string `json:"phone"`
+	Service    int16  `json:"service"`
+	StartTime  string `json:"start_time"`
+	EndTime    string `json:"end_time"`
+	UserId     int    `json:"user_id"`
+	CreatedBy  int    `json:"created_by"`
+	OnBehalfOf int    `json:"on_behalf_of,omitempty"`
+	StylistId  int    `json:"stylist_id"`
+	Language   string `json:"language,omitempty"`
 }
 
 type User struct {
@@ -19,6 +23,8 @@ type User struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 	ApiKey   string `json:"api_key"`
+	Role     string `json:"role,omitempty"`
+	Language string `json:"language,omitempty"`
 }
 
 type Service struct {
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Every user, and every guest email that received something, has a
+// notification profile. It holds the preferences that differ from the
+// defaults and a permanent token for the unsubscribe links, so guests can
+// manage their notifications without an account. Transactional mail about
+// the account itself (verification, password resets) is always sent.
+
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+	// ChannelPush is stored for clients to offer, nothing delivers it yet.
+	ChannelPush = "push"
+
+	CategoryConfirmations = "confirmations"
+	CategoryReminders     = "reminders"
+	CategoryMarketing     = "marketing"
+)
+
+var (
+	notificationChannels   = []string{ChannelEmail, ChannelSMS, ChannelPush}
+	notificationCategories = []string{CategoryConfirmations, CategoryReminders, CategoryMarketing}
+)
+
+// NotificationPreferences maps channel to category to whether it is enabled.
+type NotificationPreferences map[string]map[string]bool
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultPreference is used when someone hasn't chosen. Marketing needs an
+// explicit opt-in.
+func defaultPreference(category string) bool {
+	return category != CategoryMarketing
+}
+
+// isTransactional reports whether a category is part of a booking the
+// customer made, as opposed to mail they can unsubscribe from.
+func isTransactional(category string) bool {
+	return category == CategoryConfirmations
+}
+
+// notificationProfile returns the profile of a user, or of a guest email when
+// userId is 0, creating it on first use.
+func notificationProfile(q queryer, userId int, email string) (int, string, error) {
+	token, err := generateAPIKey()
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to generate unsubscribe token: %v", err)
+	}
+	var id int
+	if userId != 0 {
+		_, err = q.Exec("INSERT INTO notification_profiles (user_id, unsubscribe_token) VALUES ($1, $2) ON CONFLICT (user_id) DO NOTHING", userId, token)
+		if err == nil {
+			err = q.QueryRow("SELECT id, unsubscribe_token FROM notification_profiles WHERE user_id = $1", userId).Scan(&id, &token)
+		}
+	} else {
+		_, err = q.Exec("INSERT INTO notification_profiles (email, unsubscribe_token) VALUES ($1, $2) ON CONFLICT ((LOWER(email))) DO NOTHING", email, token)
+		if err == nil {
+			err = q.QueryRow("SELECT id, unsubscribe_token FROM notification_profiles WHERE LOWER(email) = LOWER($1)", email).Scan(&id, &token)
+		}
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to fetch notification profile: %v", err)
+	}
+	return id, token, nil
+}
+
+// notificationAllowed checks the preferences of a user, or of a guest email
+// when userId is 0. A user's own settings win over those of their address.
+func notificationAllowed(q queryer, userId int, email, channel, category string) (bool, error) {
+	var enabled bool
+	err := q.QueryRow(`
+        SELECT notification_preferences.enabled FROM notification_preferences
+        JOIN notification_profiles ON notification_profiles.id = notification_preferences.profile_id
+        WHERE notification_preferences.channel = $1 AND notification_preferences.category = $2
+            AND (notification_profiles.user_id = $3 OR ($4 <> '' AND LOWER(notification_profiles.email) = LOWER($4)))
+        ORDER BY notification_profiles.user_id NULLS LAST
+        LIMIT 1
+    `, channel, category, userId, email).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return defaultPreference(category), nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check notification preferences: %v", err)
+	}
+	return enabled, nil
+}
+
+func loadPreferences(q queryer, profileId int) (NotificationPreferences, error) {
+	prefs := NotificationPreferences{}
+	for _, channel := range notificationChannels {
+		prefs[channel] = map[string]bool{}
+		for _, category := range notificationCategories {
+			prefs[channel][category] = defaultPreference(category)
+		}
+	}
+	rows, err := q.Query("SELECT channel, category, enabled FROM notification_preferences WHERE profile_id = $1", profileId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch notification preferences: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel, category string
+		var enabled bool
+		if err := rows.Scan(&channel, &category, &enabled); err != nil {
+			return nil, fmt.Errorf("failed to scan notification preference: %v", err)
+		}
+		prefs[channel][category] = enabled
+	}
+	return prefs, nil
+}
+
+func setPreference(q queryer, profileId int, channel, category string, enabled bool) error {
+	_, err := q.Exec(`
+        INSERT INTO notification_preferences (profile_id, channel, category, enabled) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (profile_id, channel, category) DO UPDATE SET enabled = EXCLUDED.enabled, updated_at = NOW()
+    `, profileId, channel, category, enabled)
+	if err != nil {
+		return fmt.Errorf("failed to save notification preference: %v", err)
+	}
+	return nil
+}
+
+func unsubscribeURL(token, category string) string {
+	return fmt.Sprintf("%s/notifications/unsubscribe?token=%s&category=%s", appURL(), url.QueryEscape(token), category)
+}
+
+// queueNotificationEmail queues a templated email about a booking if the
+// recipient wants it. Non-transactional mail gets an unsubscribe link and
+// List-Unsubscribe headers.
+func queueNotificationEmail(tx *sql.Tx, userId int, to, name, lang, category string, data map[string]interface{}) error {
+	if to == "" {
+		return nil
+	}
+	allowed, err := notificationAllowed(tx, userId, to, ChannelEmail, category)
+	if err != nil || !allowed {
+		return err
+	}
+	var link string
+	if !isTransactional(category) {
+		_, token, err := notificationProfile(tx, userId, to)
+		if err != nil {
+			return err
+		}
+		link = unsubscribeURL(token, category)
+		data["UnsubscribeURL"] = link
+	}
+	msg, err := renderEmail(to, name, lang, data)
+	if err != nil {
+		return err
+	}
+	msg.UnsubscribeURL = link
+	return queueEmail(tx, msg)
+}
+
+// decodePreferences validates a {"email": {"reminders": false}} style body.
+func decodePreferences(r *http.Request) (NotificationPreferences, error) {
+	var prefs NotificationPreferences
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		return nil, fmt.Errorf("Bad Request")
+	}
+	for channel, categories := range prefs {
+		if !contains(notificationChannels, channel) {
+			return nil, fmt.Errorf("Unknown channel %q", channel)
+		}
+		for category := range categories {
+			if !contains(notificationCategories, category) {
+				return nil, fmt.Errorf("Unknown category %q", category)
+			}
+		}
+	}
+	return prefs, nil
+}
+
+// notificationPreferencesHandler shows (GET) or changes (POST) preferences.
+// Logged in users manage their own; guests use the token from an unsubscribe
+// link.
+func notificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var profileId int
+	if token := r.URL.Query().Get("token"); token != "" {
+		err := db.QueryRow("SELECT id FROM notification_profiles WHERE unsubscribe_token = $1", token).Scan(&profileId)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid link", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch notification profile: %v", err), http.StatusInternalServerError)
+			return
+		}
+	} else if caller := currentPrincipal(r); caller != nil {
+		var err error
+		profileId, _, err = notificationProfile(db, caller.UserId, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		prefs, err := decodePreferences(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to save notification preferences: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		before, err := loadPreferences(tx, profileId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for channel, categories := range prefs {
+			for category, enabled := range categories {
+				if err := setPreference(tx, profileId, channel, category, enabled); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+		after, err := loadPreferences(tx, profileId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		actorId := 0
+		if caller := currentPrincipal(r); caller != nil {
+			actorId = caller.UserId
+		}
+		if err := recordChange(tx, actorId, "notifications.preferences_updated", "notification_profile", profileId, clientIP(r), before, after); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to save notification preferences: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	prefs, err := loadPreferences(db, profileId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Salon}}</title></head>
+<body style="font-family: Arial, Helvetica, sans-serif; text-align: center; padding: 48px;">
+{{if .Done}}<p>Wypisano. / You have been unsubscribed.</p>
+{{else}}<form method="post">
+<p>Wypisać się z tych wiadomości? / Unsubscribe from these emails?</p>
+<button type="submit">Wypisz / Unsubscribe</button>
+</form>{{end}}
+</body>
+</html>
+`))
+
+// unsubscribeHandler turns off email for one category, or for everything
+// that isn't transactional when no category is given. GET only shows a
+// button, so link scanners in mail filters don't unsubscribe anyone; mail
+// clients use the one-click POST from the List-Unsubscribe-Post header.
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	categories := []string{}
+	for _, category := range notificationCategories {
+		if !isTransactional(category) && (query.Get("category") == "" || query.Get("category") == category) {
+			categories = append(categories, category)
+		}
+	}
+	if len(categories) == 0 {
+		http.Error(w, "Invalid category", http.StatusBadRequest)
+		return
+	}
+	var profileId int
+	err := db.QueryRow("SELECT id FROM notification_profiles WHERE unsubscribe_token = $1", query.Get("token")).Scan(&profileId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid link", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch notification profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		for _, category := range categories {
+			if err := setPreference(db, profileId, ChannelEmail, category, false); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		recordAudit(0, "notifications.unsubscribed", "notification_profile", profileId, clientIP(r), map[string]interface{}{
+			"categories": strings.Join(categories, ","),
+		})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	unsubscribePage.Execute(w, map[string]interface{}{"Salon": salonName(), "Done": r.Method == http.MethodPost})
+}
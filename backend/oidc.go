@@ -0,0 +1,626 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect relying party using the authorization code flow with PKCE.
+// Users are matched by provider and subject. Existing accounts are linked
+// only explicitly, by their owner after a password login.
+
+type OIDCConfig struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RedirectURL  string `json:"redirect_url"`
+	// AuthorizationEndpoint overrides the discovered one, for providers the
+	// backend reaches under a different host than the browser does.
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	Scopes                []string `json:"scopes"`
+}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var (
+	oidcMu       sync.Mutex
+	oidcConfig   *OIDCConfig
+	oidcMetadata *oidcProvider
+	oidcKeys     map[string]jsonWebKey
+	oidcClient   = &http.Client{Timeout: 10 * time.Second}
+)
+
+// loadOIDCConfig reads OIDC_CONFIG_FILE if set and lets OIDC_* environment
+// variables override its values. It returns nil when OIDC is not configured.
+func loadOIDCConfig() (*OIDCConfig, error) {
+	cfg := &OIDCConfig{}
+	if path := os.Getenv("OIDC_CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OIDC config: %v", err)
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse OIDC config: %v", err)
+		}
+	}
+	for env, field := range map[string]*string{
+		"OIDC_ISSUER":                 &cfg.Issuer,
+		"OIDC_CLIENT_ID":              &cfg.ClientID,
+		"OIDC_CLIENT_SECRET":          &cfg.ClientSecret,
+		"OIDC_REDIRECT_URL":           &cfg.RedirectURL,
+		"OIDC_AUTHORIZATION_ENDPOINT": &cfg.AuthorizationEndpoint,
+	} {
+		if value := os.Getenv(env); value != "" {
+			*field = value
+		}
+	}
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, nil
+	}
+	cfg.Issuer = strings.TrimRight(cfg.Issuer, "/")
+	if cfg.RedirectURL == "" {
+		cfg.RedirectURL = appURL() + "/auth/oidc/callback"
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return cfg, nil
+}
+
+func fetchJSON(rawURL string, v interface{}) error {
+	resp, err := oidcClient.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s returned status %d: %s", rawURL, resp.StatusCode, string(body))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// oidcSetup returns the configuration and the discovered provider metadata.
+// Discovery is retried on the next call if it fails.
+func oidcSetup() (*OIDCConfig, *oidcProvider, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcConfig == nil {
+		cfg, err := loadOIDCConfig()
+		if err != nil || cfg == nil {
+			return nil, nil, err
+		}
+		oidcConfig = cfg
+	}
+	if oidcMetadata == nil {
+		var provider oidcProvider
+		err := fetchJSON(oidcConfig.Issuer+"/.well-known/openid-configuration", &provider)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to discover OIDC provider: %v", err)
+		}
+		if strings.TrimRight(provider.Issuer, "/") != oidcConfig.Issuer {
+			return nil, nil, fmt.Errorf("OIDC provider reports issuer %q, expected %q", provider.Issuer, oidcConfig.Issuer)
+		}
+		if oidcConfig.AuthorizationEndpoint != "" {
+			provider.AuthorizationEndpoint = oidcConfig.AuthorizationEndpoint
+		}
+		oidcMetadata = &provider
+	}
+	return oidcConfig, oidcMetadata, nil
+}
+
+// oidcKey finds a signing key by ID, refreshing the key set once when the
+// provider has rotated its keys.
+func oidcKey(jwksURI, kid string) (jsonWebKey, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if key, ok := oidcKeys[kid]; ok {
+		return key, nil
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := fetchJSON(jwksURI, &set); err != nil {
+		return jsonWebKey{}, fmt.Errorf("failed to fetch signing keys: %v", err)
+	}
+	oidcKeys = map[string]jsonWebKey{}
+	for _, key := range set.Keys {
+		oidcKeys[key.Kid] = key
+	}
+	key, ok := oidcKeys[kid]
+	if !ok {
+		return key, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+func verifyJWTSignature(alg string, key jsonWebKey, signingInput string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+	switch alg {
+	case "RS256":
+		n, err := decodeSegment(key.N)
+		if err != nil {
+			return err
+		}
+		e, err := decodeSegment(key.E)
+		if err != nil {
+			return err
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+	case "ES256":
+		x, err := decodeSegment(key.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeSegment(key.Y)
+		if err != nil {
+			return err
+		}
+		if len(signature) != 64 {
+			return errors.New("malformed ES256 signature")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return errors.New("invalid ES256 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported signing algorithm %q", alg)
+}
+
+type idTokenClaims struct {
+	Issuer        string      `json:"iss"`
+	Subject       string      `json:"sub"`
+	Audience      interface{} `json:"aud"`
+	Expiry        float64     `json:"exp"`
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	GivenName     string      `json:"given_name"`
+	FamilyName    string      `json:"family_name"`
+	Name          string      `json:"name"`
+}
+
+func (c idTokenClaims) hasAudience(clientID string) bool {
+	switch aud := c.Audience.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// emailVerified accepts both booleans and the "true" strings some providers
+// send.
+func (c idTokenClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+func verifyIDToken(cfg *OIDCConfig, provider *oidcProvider, token, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := decodeSegment(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	key, err := oidcKey(provider.JWKSURI, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, fmt.Errorf("invalid ID token signature: %v", err)
+	}
+
+	var claims idTokenClaims
+	raw, err = decodeSegment(parts[1])
+	if err != nil || json.Unmarshal(raw, &claims) != nil {
+		return nil, errors.New("malformed ID token claims")
+	}
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != cfg.Issuer:
+		return nil, errors.New("ID token has the wrong issuer")
+	case !claims.hasAudience(cfg.ClientID):
+		return nil, errors.New("ID token has the wrong audience")
+	case time.Unix(int64(claims.Expiry), 0).Add(time.Minute).Before(time.Now()):
+		return nil, errors.New("ID token has expired")
+	case claims.Nonce != nonce:
+		return nil, errors.New("ID token nonce does not match")
+	case claims.Subject == "":
+		return nil, errors.New("ID token has no subject")
+	}
+	return &claims, nil
+}
+
+// oidcAuthorizeURL stores a new login attempt and returns the provider URL
+// to send the browser to. linkUserId is set when a logged in user links the
+// provider to their account.
+func oidcAuthorizeURL(cfg *OIDCConfig, provider *oidcProvider, linkUserId int) (string, error) {
+	state, err := generateAPIKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate state: %v", err)
+	}
+	nonce, err := generateAPIKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	verifier, err := generateAPIKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate verifier: %v", err)
+	}
+	// Kept in the database rather than in memory so the callback may land on
+	// any backend replica.
+	_, err = db.Exec(
+		"INSERT INTO oidc_states (state_hash, code_verifier, nonce, expires_at, link_user_id) VALUES ($1, $2, $3, $4, $5)",
+		hashToken(state),
+		verifier,
+		nonce,
+		time.Now().Add(10*time.Minute),
+		sql.NullInt64{Int64: int64(linkUserId), Valid: linkUserId != 0},
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to store login state: %v", err)
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", cfg.ClientID)
+	query.Set("redirect_uri", cfg.RedirectURL)
+	query.Set("scope", strings.Join(cfg.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	return provider.AuthorizationEndpoint + "?" + query.Encode(), nil
+}
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, provider, err := oidcSetup()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if cfg == nil {
+		http.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return
+	}
+	target, err := oidcAuthorizeURL(cfg, provider, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// oidcLinkHandler starts linking the provider to the caller's account. Existing
+// accounts are never linked by email alone, so the user confirms with their
+// password and then opens the returned URL in the browser.
+func oidcLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokenProfileChanges(w, r) {
+		return
+	}
+	cfg, provider, err := oidcSetup()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if cfg == nil {
+		http.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	caller := currentPrincipal(r)
+	if !checkPassword(w, caller.UserId, body.Password) {
+		return
+	}
+	target, err := oidcAuthorizeURL(cfg, provider, caller.UserId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": target})
+}
+
+func exchangeOIDCCode(cfg *OIDCConfig, provider *oidcProvider, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", cfg.RedirectURL)
+	form.Set("client_id", cfg.ClientID)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call token endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, string(body))
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %v", err)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token response has no ID token")
+	}
+	return tokens.IDToken, nil
+}
+
+// findOrCreateOIDCUser returns the user linked to the identity, creating one
+// on first login. An existing account with the same email is not taken over:
+// a provider vouching for an address is not enough to log in as its owner,
+// so the user has to link the provider after logging in with their password.
+func findOrCreateOIDCUser(issuer string, claims *idTokenClaims) (int, error) {
+	var userId int
+	err := db.QueryRow("SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2", issuer, claims.Subject).Scan(&userId)
+	if err == nil {
+		return userId, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to fetch identity: %v", err)
+	}
+	if claims.Email == "" || !claims.emailVerified() {
+		return 0, errors.New("the identity provider did not confirm a verified email address")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT id FROM users WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NOT NULL", claims.Email).Scan(&userId)
+	if err == nil {
+		return 0, errors.New("an account with this email already exists, log in with your password and link the provider in your profile")
+	}
+	if err == sql.ErrNoRows {
+		// Like a normal registration, this takes over an unverified account.
+		if _, err := tx.Exec("DELETE FROM users WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NULL", claims.Email); err != nil {
+			return 0, fmt.Errorf("failed to replace unverified account: %v", err)
+		}
+		name, surname := claims.GivenName, claims.FamilyName
+		if name == "" {
+			name = claims.Name
+		}
+		if name == "" {
+			name = strings.Split(claims.Email, "@")[0]
+		}
+		// The account gets a random password; the user can set a real one
+		// through the password reset flow.
+		random, err := generateAPIKey()
+		if err != nil {
+			return 0, err
+		}
+		password, err := encryptPassword(random)
+		if err != nil {
+			return 0, err
+		}
+		apiKey, err := generateAPIKey()
+		if err != nil {
+			return 0, err
+		}
+		err = tx.QueryRow(
+			"INSERT INTO users (name, surname, email, password, api_key, email_verified_at) VALUES ($1, $2, $3, $4, $5, NOW()) RETURNING id",
+			name, surname, claims.Email, password, apiKey,
+		).Scan(&userId)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create user: %v", err)
+		}
+		registered := RegisteredUser{Id: userId, Name: name, Surname: surname, Email: claims.Email, Role: RoleCustomer, Source: "oidc"}
+		if err := queueWebhookEvent(tx, EventUserRegistered, registered); err != nil {
+			return 0, err
+		}
+		if err := writeAudit(tx, userId, "user.registered", "user", userId, "", map[string]interface{}{"email": claims.Email, "issuer": issuer}, nil); err != nil {
+			return 0, err
+		}
+	} else {
+		return 0, fmt.Errorf("failed to fetch user: %v", err)
+	}
+
+	_, err = tx.Exec("INSERT INTO user_identities (user_id, issuer, subject) VALUES ($1, $2, $3)", userId, issuer, claims.Subject)
+	if err != nil {
+		return 0, fmt.Errorf("failed to link identity: %v", err)
+	}
+	return userId, tx.Commit()
+}
+
+// linkOIDCIdentity attaches the identity to an account whose owner started
+// the link with their password.
+func linkOIDCIdentity(userId int, issuer string, claims *idTokenClaims, ip string) error {
+	var owner int
+	err := db.QueryRow(`
+        INSERT INTO user_identities (user_id, issuer, subject) VALUES ($1, $2, $3)
+        ON CONFLICT (issuer, subject) DO UPDATE SET issuer = EXCLUDED.issuer
+        RETURNING user_id
+    `, userId, issuer, claims.Subject).Scan(&owner)
+	if err != nil {
+		return fmt.Errorf("failed to link identity: %v", err)
+	}
+	if owner != userId {
+		return errors.New("this identity is already linked to another account")
+	}
+	recordAudit(userId, "user.oidc_linked", "user", userId, ip, map[string]interface{}{"issuer": issuer})
+	return nil
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, provider, err := oidcSetup()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if cfg == nil {
+		http.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return
+	}
+	if msg := r.URL.Query().Get("error"); msg != "" {
+		http.Error(w, "Login was cancelled: "+msg, http.StatusUnauthorized)
+		return
+	}
+
+	var verifier, nonce string
+	var linkUserId sql.NullInt64
+	err = db.QueryRow(
+		"DELETE FROM oidc_states WHERE state_hash = $1 AND expires_at > NOW() RETURNING code_verifier, nonce, link_user_id",
+		hashToken(r.URL.Query().Get("state")),
+	).Scan(&verifier, &nonce, &linkUserId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired login attempt, please try again", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch login state: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	idToken, err := exchangeOIDCCode(cfg, provider, r.URL.Query().Get("code"), verifier)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	claims, err := verifyIDToken(cfg, provider, idToken, nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if linkUserId.Valid {
+		if err := linkOIDCIdentity(int(linkUserId.Int64), cfg.Issuer, claims, clientIP(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Redirect(w, r, appURL()+"/#oidc_linked=true", http.StatusFound)
+		return
+	}
+	userId, err := findOrCreateOIDCUser(cfg.Issuer, claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The provider's login doesn't satisfy our own second factor.
+	var totpEnabled, disabled bool
+	err = db.QueryRow("SELECT totp_enabled, disabled_at IS NOT NULL FROM users WHERE id = $1", userId).Scan(&totpEnabled, &disabled)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if disabled {
+		http.Error(w, "This account has been disabled", http.StatusForbidden)
+		return
+	}
+	if totpEnabled {
+		http.Error(w, "This account uses two-factor authentication, please log in with your password", http.StatusForbidden)
+		return
+	}
+
+	tokens, err := createSession(userId, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d logged in through %s", userId, cfg.Issuer)
+
+	// Tokens go in the fragment so they never reach server logs.
+	fragment := url.Values{}
+	fragment.Set("access_token", tokens.AccessToken)
+	fragment.Set("refresh_token", tokens.RefreshToken)
+	http.Redirect(w, r, appURL()+"/#"+fragment.Encode(), http.StatusFound)
+}
+
+func pruneOIDCStates() error {
+	_, err := db.Exec("DELETE FROM oidc_states WHERE expires_at < NOW()")
+	if err != nil {
+		return fmt.Errorf("failed to prune OIDC states: %v", err)
+	}
+	return nil
+}
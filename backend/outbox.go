@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notifications are written to email_outbox in the same transaction as the
+// change that caused them and delivered by a background worker, so a slow or
+// failing mail server neither delays requests nor loses messages. Messages
+// that keep failing end up as "dead" for a manager to look at and retry.
+
+const (
+	outboxBatchSize  = 20
+	outboxBaseDelay  = 30 * time.Second
+	outboxMaxDelay   = 6 * time.Hour
+	outboxDefaultMax = 8
+	// outboxClaim is how long a worker has to send a claimed batch.
+	outboxClaim = 5 * time.Minute
+)
+
+type OutboxMessage struct {
+	Id            int        `json:"id"`
+	Recipient     string     `json:"recipient"`
+	Subject       string     `json:"subject"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     string     `json:"last_error"`
+	CreatedAt     time.Time  `json:"created_at"`
+	SentAt        *time.Time `json:"sent_at"`
+}
+
+func outboxMaxAttempts() int {
+	if n, err := strconv.Atoi(os.Getenv("OUTBOX_MAX_ATTEMPTS")); err == nil && n > 0 {
+		return n
+	}
+	return outboxDefaultMax
+}
+
+// queueEmail adds a message to the outbox as part of tx.
+func queueEmail(tx *sql.Tx, msg Message) error {
+	_, err := tx.Exec(
+		"INSERT INTO email_outbox (recipient, subject, body, html, unsubscribe_url) VALUES ($1, $2, $3, $4, $5)",
+		msg.To, msg.Subject, msg.Body, sql.NullString{String: msg.HTML, Valid: msg.HTML != ""},
+		sql.NullString{String: msg.UnsubscribeURL, Valid: msg.UnsubscribeURL != ""},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to queue email: %v", err)
+	}
+	return nil
+}
+
+// Outcomes of a delivery attempt, shared by the email, SMS and webhook
+// workers.
+const (
+	deliveryDone = iota
+	deliveryRetry
+	deliveryDead
+)
+
+// deliveryOutcome decides what happens after the attempts-th try: the
+// message is done, tried again after outboxRetryDelay or given up on.
+func deliveryOutcome(attempts, maxAttempts int, sendErr error) int {
+	switch {
+	case sendErr == nil:
+		return deliveryDone
+	case attempts >= maxAttempts:
+		return deliveryDead
+	}
+	return deliveryRetry
+}
+
+// outboxRetryDelay doubles the wait after every failed attempt.
+func outboxRetryDelay(attempts int) time.Duration {
+	delay := time.Duration(math.Pow(2, float64(attempts-1))) * outboxBaseDelay
+	if delay > outboxMaxDelay || delay <= 0 {
+		return outboxMaxDelay
+	}
+	return delay
+}
+
+// deliverOutbox sends the messages that are due. A batch is claimed by moving
+// its next attempt outboxClaim ahead, with SKIP LOCKED so several backend
+// replicas never claim the same message, and no transaction stays open while
+// talking to the mail server. Messages of a worker that dies mid-batch are
+// picked up again once the claim runs out.
+func deliverOutbox() error {
+	rows, err := db.Query(`
+        UPDATE email_outbox SET next_attempt_at = $2
+        WHERE id IN (
+            SELECT id FROM email_outbox
+            WHERE status = 'pending' AND next_attempt_at <= NOW()
+            ORDER BY next_attempt_at
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, recipient, subject, body, COALESCE(html, ''), COALESCE(unsubscribe_url, ''), attempts
+    `, outboxBatchSize, time.Now().Add(outboxClaim))
+	if err != nil {
+		return fmt.Errorf("failed to claim outbox messages: %v", err)
+	}
+	type pending struct {
+		id       int
+		msg      Message
+		attempts int
+	}
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.msg.To, &p.msg.Subject, &p.msg.Body, &p.msg.HTML, &p.msg.UnsubscribeURL, &p.attempts); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan outbox message: %v", err)
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+
+	maxAttempts := outboxMaxAttempts()
+	for _, p := range batch {
+		p.attempts++
+		sendErr := sendEmail(p.msg)
+		switch deliveryOutcome(p.attempts, maxAttempts, sendErr) {
+		case deliveryDone:
+			_, err = db.Exec("UPDATE email_outbox SET status = 'sent', attempts = $1, sent_at = NOW(), last_error = NULL WHERE id = $2", p.attempts, p.id)
+		case deliveryDead:
+			log.Printf("Giving up on email %d to %s after %d attempts: %v", p.id, p.msg.To, p.attempts, sendErr)
+			_, err = db.Exec("UPDATE email_outbox SET status = 'dead', attempts = $1, last_error = $2 WHERE id = $3", p.attempts, sendErr.Error(), p.id)
+		default:
+			_, err = db.Exec(
+				"UPDATE email_outbox SET attempts = $1, last_error = $2, next_attempt_at = $3 WHERE id = $4",
+				p.attempts, sendErr.Error(), time.Now().Add(outboxRetryDelay(p.attempts)), p.id,
+			)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update outbox message %d: %v", p.id, err)
+		}
+	}
+	return nil
+}
+
+func pruneOutbox() error {
+	_, err := db.Exec("DELETE FROM email_outbox WHERE status = 'sent' AND sent_at < $1", time.Now().Add(-7*24*time.Hour))
+	if err != nil {
+		return fmt.Errorf("failed to prune outbox: %v", err)
+	}
+	return nil
+}
+
+// listOutboxHandler shows queued messages, by default the ones that gave up.
+func listOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "dead"
+	}
+	if status != "pending" && status != "sent" && status != "dead" {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(
+		"SELECT id, recipient, subject, status, attempts, next_attempt_at, COALESCE(last_error, ''), created_at, sent_at FROM email_outbox WHERE status = $1 ORDER BY created_at DESC LIMIT 200",
+		status,
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch outbox: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	messages := []OutboxMessage{}
+	for rows.Next() {
+		var m OutboxMessage
+		err := rows.Scan(&m.Id, &m.Recipient, &m.Subject, &m.Status, &m.Attempts, &m.NextAttemptAt, &m.LastError, &m.CreatedAt, &m.SentAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan outbox message: %v", err), http.StatusInternalServerError)
+			return
+		}
+		messages = append(messages, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// retryOutboxHandler queues a dead message again, or every dead message when
+// no id is given.
+func retryOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Id int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec(
+		"UPDATE email_outbox SET status = 'pending', attempts = 0, next_attempt_at = NOW() WHERE status = 'dead' AND ($1 = 0 OR id = $1)",
+		body.Id,
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retry messages: %v", err), http.StatusInternalServerError)
+		return
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 && body.Id != 0 {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(currentPrincipal(r).UserId, "mail.retried", "email_outbox", body.Id, clientIP(r), map[string]interface{}{"count": n})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"retried": n})
+}
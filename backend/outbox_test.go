@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyMailer fails the first failures sends and records every attempt.
+type flakyMailer struct {
+	failures int
+	sent     []Message
+}
+
+func (m *flakyMailer) Send(msg Message) error {
+	m.sent = append(m.sent, msg)
+	if len(m.sent) <= m.failures {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestOutboxRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, outboxMaxDelay},
+		{100, outboxMaxDelay},
+	}
+	for _, tt := range tests {
+		if got := outboxRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("outboxRetryDelay(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDeliveryOutcome(t *testing.T) {
+	failed := errors.New("timeout")
+	tests := []struct {
+		name     string
+		attempts int
+		max      int
+		err      error
+		want     int
+	}{
+		{"first attempt succeeds", 1, 8, nil, deliveryDone},
+		{"last attempt succeeds", 8, 8, nil, deliveryDone},
+		{"first attempt fails", 1, 8, failed, deliveryRetry},
+		{"one attempt left", 7, 8, failed, deliveryRetry},
+		{"last attempt fails", 8, 8, failed, deliveryDead},
+		{"limit lowered since", 9, 3, failed, deliveryDead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deliveryOutcome(tt.attempts, tt.max, tt.err); got != tt.want {
+				t.Errorf("deliveryOutcome(%d, %d, %v) = %d, want %d", tt.attempts, tt.max, tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestOutboxDelivery runs a message through the worker's attempt loop with a
+// mailer that fails a number of times before it recovers.
+func TestOutboxDelivery(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		max          int
+		wantOutcome  int
+		wantAttempts int
+	}{
+		{"sent on first try", 0, 8, deliveryDone, 1},
+		{"sent after retries", 3, 8, deliveryDone, 4},
+		{"sent on last try", 7, 8, deliveryDone, 8},
+		{"dead-lettered", 100, 8, deliveryDead, 8},
+		{"dead-lettered with one attempt", 100, 1, deliveryDead, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &flakyMailer{failures: tt.failures}
+			msg := Message{To: "jan@example.com", Subject: "Przypomnienie", Body: "Do zobaczenia"}
+
+			var delays []time.Duration
+			attempts, outcome := 0, deliveryRetry
+			for outcome == deliveryRetry {
+				attempts++
+				outcome = deliveryOutcome(attempts, tt.max, m.Send(msg))
+				if outcome == deliveryRetry {
+					delays = append(delays, outboxRetryDelay(attempts))
+				}
+			}
+
+			if outcome != tt.wantOutcome || attempts != tt.wantAttempts {
+				t.Errorf("got outcome %d after %d attempts, want %d after %d", outcome, attempts, tt.wantOutcome, tt.wantAttempts)
+			}
+			if len(m.sent) != attempts {
+				t.Errorf("mailer saw %d sends, want %d", len(m.sent), attempts)
+			}
+			for i := 1; i < len(delays); i++ {
+				if delays[i] <= delays[i-1] {
+					t.Errorf("retry %d waits %v, not longer than %v before it", i+1, delays[i], delays[i-1])
+				}
+			}
+		})
+	}
+}
+
+func TestLogMailer(t *testing.T) {
+	var out bytes.Buffer
+	m := &LogMailer{Out: &out}
+	if err := m.Send(Message{To: "jan@example.com", Subject: "Potwierdzenie", Body: "Wizyta 12:00"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	for _, want := range []string{"email to jan@example.com", "Subject: Potwierdzenie", "Wizyta 12:00"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output %q does not contain %q", out.String(), want)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Bookings keep their own copy of the customer's contact details. Profile
+// changes are copied to upcoming bookings only, past ones stay as they were.
+
+func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokenProfileChanges(w, r) {
+		return
+	}
+	caller := currentPrincipal(r)
+
+	var u User
+	err := json.NewDecoder(r.Body).Decode(&u)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(u.Name) == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if u.Language != "" && !isValidLanguage(u.Language) {
+		http.Error(w, "Unsupported language", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var before, after struct {
+		Name     string `json:"name"`
+		Surname  string `json:"surname"`
+		Language string `json:"language"`
+	}
+	err = tx.QueryRow(`
+        UPDATE users SET name = $1, surname = $2, language = COALESCE($3, users.language)
+        FROM (SELECT id, name, COALESCE(surname, '') AS surname, COALESCE(language, '') AS language FROM users WHERE id = $4 FOR UPDATE) AS old
+        WHERE users.id = old.id
+        RETURNING old.name, old.surname, old.language, COALESCE(users.language, '')`,
+		u.Name, u.Surname, sql.NullString{String: u.Language, Valid: u.Language != ""}, caller.UserId,
+	).Scan(&before.Name, &before.Surname, &before.Language, &after.Language)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+	after.Name, after.Surname = u.Name, u.Surname
+	if err := recordChange(tx, caller.UserId, "user.profile_updated", "user", caller.UserId, clientIP(r), before, after); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = updateUpcomingBookings(tx, caller.UserId, clientIP(r),
+		sql.NullString{String: u.Name, Valid: true}, sql.NullString{String: u.Surname, Valid: true}, sql.NullString{})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update bookings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update profile: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// updateUpcomingBookings copies the given details to the user's upcoming
+// bookings. Each booking that changes is recorded and published like any
+// other edit.
+func updateUpcomingBookings(tx *sql.Tx, userId int, ip string, name, surname, email sql.NullString) error {
+	rows, err := tx.Query(`
+        UPDATE bookings SET name = COALESCE($2, name), surname = COALESCE($3, surname), email = COALESCE($4, email)
+        FROM (
+            SELECT id AS old_id, name AS old_name, surname AS old_surname, email AS old_email
+            FROM bookings WHERE user_id = $1 AND start_time > NOW() AT TIME ZONE $5 FOR UPDATE
+        ) old
+        WHERE bookings.id = old.old_id
+        RETURNING old.old_name, old.old_surname, old.old_email, `+bookingColumns,
+		userId, name, surname, email, salonTimezone(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update bookings: %v", err)
+	}
+	defer rows.Close()
+
+	var befores, afters []Booking
+	for rows.Next() {
+		var oldName, oldSurname, oldEmail string
+		var after Booking
+		err := rows.Scan(&oldName, &oldSurname, &oldEmail,
+			&after.Id, &after.UserId, &after.CreatedBy, &after.StylistId, &after.Name, &after.Surname, &after.Email, &after.Phone, &after.Service, &after.StartTime, &after.EndTime, &after.Language)
+		if err != nil {
+			return fmt.Errorf("failed to scan booking: %v", err)
+		}
+		before := after
+		before.Name, before.Surname, before.Email = oldName, oldSurname, oldEmail
+		befores = append(befores, before)
+		afters = append(afters, after)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to update bookings: %v", err)
+	}
+	rows.Close()
+
+	for i, after := range afters {
+		if befores[i] == after {
+			continue
+		}
+		if err := recordChange(tx, userId, "booking.updated", "booking", after.Id, ip, befores[i], after); err != nil {
+			return err
+		}
+		if err := publishBookingEvent(tx, EventBookingUpdated, after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokenProfileChanges(w, r) {
+		return
+	}
+	caller := currentPrincipal(r)
+
+	var body struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.NewPassword == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !checkPassword(w, caller.UserId, body.CurrentPassword) {
+		return
+	}
+
+	encryptedPassword, err := encryptPassword(body.NewPassword)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encrypt password: %v", err), http.StatusInternalServerError)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update password: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET password = $1 WHERE id = $2", encryptedPassword, caller.UserId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update password: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// Everyone else who knew the old password is logged out, the current
+	// session stays.
+	if err := revokeAllCredentials(tx, caller.UserId, caller.SessionId); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to revoke credentials: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update password: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(caller.UserId, "user.password_changed", "user", caller.UserId, clientIP(r), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// forbidAccessTokenProfileChanges keeps a leaked access token from being used
+// to take over the account.
+func forbidAccessTokenProfileChanges(w http.ResponseWriter, r *http.Request) bool {
+	if currentPrincipal(r).TokenId != 0 {
+		http.Error(w, "Access tokens cannot change account details, log in instead", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// checkPassword writes an error response and returns false if the password
+// doesn't match the user's.
+func checkPassword(w http.ResponseWriter, userId int, password string) bool {
+	var encryptedPassword string
+	err := db.QueryRow("SELECT password FROM users WHERE id = $1", userId).Scan(&encryptedPassword)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch user: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	if decryptPassword(encryptedPassword, password) != nil {
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func changeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokenProfileChanges(w, r) {
+		return
+	}
+	caller := currentPrincipal(r)
+
+	var body struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || !strings.Contains(body.Email, "@") {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !checkPassword(w, caller.UserId, body.Password) {
+		return
+	}
+	taken, err := validateUserExistence(body.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Email already registered", http.StatusConflict)
+		return
+	}
+
+	// The new address only replaces the old one once it has been verified.
+	_, err = db.Exec("UPDATE users SET pending_email = $1 WHERE id = $2", body.Email, caller.UserId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to store new email: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("UPDATE email_tokens SET used_at = NOW() WHERE user_id = $1 AND purpose = 'change_email' AND used_at IS NULL", caller.UserId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to invalidate old links: %v", err), http.StatusInternalServerError)
+		return
+	}
+	token, err := createEmailToken(db, caller.UserId, "change_email", durationFromEnv("EMAIL_VERIFICATION_TTL", 48*time.Hour))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	lang := userLanguage(caller.UserId)
+	err = sendTemplatedEmail(body.Email, "email_change_confirm", lang, map[string]interface{}{
+		"Link": fmt.Sprintf("%s/auth/confirmEmailChange?token=%s", appURL(), token),
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to send verification email: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = sendTemplatedEmail(caller.Email, "email_change_notice", lang, map[string]interface{}{"NewEmail": body.Email})
+	if err != nil {
+		log.Printf("Failed to notify %s about email change: %v", caller.Email, err)
+	}
+	recordAudit(caller.UserId, "user.email_change_requested", "user", caller.UserId, clientIP(r), map[string]interface{}{"to": body.Email})
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Check the new inbox to confirm the change")
+}
+
+func confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+
+	userId, err := consumeEmailToken(db, token, "change_email")
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to validate token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to change email: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var oldEmail, newEmail string
+	err = tx.QueryRow("SELECT email, COALESCE(pending_email, '') FROM users WHERE id = $1 FOR UPDATE", userId).Scan(&oldEmail, &newEmail)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if newEmail == "" {
+		http.Error(w, "No email change pending", http.StatusBadRequest)
+		return
+	}
+	// Someone may have verified the address in the meantime.
+	var taken bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NOT NULL AND id <> $2)", newEmail, userId).Scan(&taken)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to check email: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Email already registered", http.StatusConflict)
+		return
+	}
+	_, err = tx.Exec("DELETE FROM users WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NULL", newEmail)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to change email: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("UPDATE users SET email = pending_email, pending_email = NULL, email_verified_at = NOW() WHERE id = $1", userId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to change email: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = updateUpcomingBookings(tx, userId, clientIP(r), sql.NullString{}, sql.NullString{}, sql.NullString{String: newEmail, Valid: true})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update bookings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to change email: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(userId, "user.email_changed", "user", userId, clientIP(r), map[string]interface{}{
+		"from": oldEmail,
+		"to":   newEmail,
+	})
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Email address changed")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Reminders are sent REMINDER_OFFSETS before each appointment. Every replica
+// runs the job, but only the one holding the advisory lock does the work, and
+// booking_reminders records which offsets were handled so nothing is sent
+// twice. Cancelled bookings are deleted and take their reminders with them.
+
+const reminderLockKey = 4301
+
+var defaultReminderOffsets = []time.Duration{24 * time.Hour, 2 * time.Hour}
+
+// reminderOffsets returns the configured offsets, largest first.
+func reminderOffsets() []time.Duration {
+	offsets := defaultReminderOffsets
+	if value := os.Getenv("REMINDER_OFFSETS"); value != "" {
+		offsets = nil
+		for _, part := range strings.Split(value, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(part))
+			if err != nil || d <= 0 {
+				log.Printf("Ignoring invalid reminder offset %q", part)
+				continue
+			}
+			offsets = append(offsets, d)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+	return offsets
+}
+
+func sendReminders() error {
+	offsets := reminderOffsets()
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start reminders: %v", err)
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", reminderLockKey).Scan(&locked); err != nil {
+		return fmt.Errorf("failed to take reminder lock: %v", err)
+	}
+	if !locked {
+		return nil
+	}
+
+	rows, err := tx.Query(`
+        SELECT bookings.id, COALESCE(bookings.user_id, 0), bookings.name, bookings.surname, bookings.email, COALESCE(bookings.phone, ''),
+            COALESCE(bookings.service, 1), bookings.start_time, bookings.end_time,
+            COALESCE(bookings.language, users.language, ''),
+            EXTRACT(EPOCH FROM bookings.start_time - (NOW() AT TIME ZONE $2)),
+            EXTRACT(EPOCH FROM bookings.start_time - (bookings.created_at AT TIME ZONE current_setting('TimeZone') AT TIME ZONE $2)),
+            ARRAY(SELECT offset_minutes FROM booking_reminders WHERE booking_id = bookings.id)
+        FROM bookings LEFT JOIN users ON users.id = bookings.user_id
+        WHERE bookings.start_time > NOW() AT TIME ZONE $2 AND bookings.start_time <= (NOW() AT TIME ZONE $2) + make_interval(secs => $1)
+            AND bookings.anonymized_at IS NULL AND (bookings.email <> '' OR bookings.phone IS NOT NULL)
+    `, offsets[0].Seconds(), salonTimezone())
+	if err != nil {
+		return fmt.Errorf("failed to fetch upcoming bookings: %v", err)
+	}
+	type upcoming struct {
+		booking Booking
+		// Seconds until the appointment, and between booking and appointment.
+		untilStart float64
+		leadTime   float64
+		handled    []int64
+	}
+	var bookings []upcoming
+	for rows.Next() {
+		var u upcoming
+		b := &u.booking
+		err := rows.Scan(&b.Id, &b.UserId, &b.Name, &b.Surname, &b.Email, &b.Phone, &b.Service, &b.StartTime, &b.EndTime, &b.Language, &u.untilStart, &u.leadTime, pq.Array(&u.handled))
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan booking: %v", err)
+		}
+		bookings = append(bookings, u)
+	}
+	rows.Close()
+
+	sent := 0
+	for _, u := range bookings {
+		// Every offset whose moment has passed is marked as handled, but only
+		// one reminder goes out. Offsets that had already passed when the
+		// booking was made are skipped; the confirmation covers them.
+		var due []time.Duration
+		for _, offset := range offsets {
+			if u.untilStart <= offset.Seconds() && !containsMinutes(u.handled, offset) {
+				due = append(due, offset)
+			}
+		}
+		if len(due) == 0 {
+			continue
+		}
+		for _, offset := range due {
+			_, err := tx.Exec("INSERT INTO booking_reminders (booking_id, offset_minutes) VALUES ($1, $2) ON CONFLICT DO NOTHING", u.booking.Id, int64(offset/time.Minute))
+			if err != nil {
+				return fmt.Errorf("failed to record reminder: %v", err)
+			}
+		}
+		if u.leadTime <= due[len(due)-1].Seconds() {
+			continue
+		}
+
+		data, err := bookingEmailData(tx, u.booking)
+		if err != nil {
+			return err
+		}
+		if err := queueNotificationEmail(tx, u.booking.UserId, u.booking.Email, "booking_reminder", u.booking.Language, CategoryReminders, data); err != nil {
+			return err
+		}
+		if err := queueBookingSMS(tx, u.booking, "booking_reminder", CategoryReminders); err != nil {
+			return err
+		}
+		sent++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to finish reminders: %v", err)
+	}
+	if sent > 0 {
+		log.Printf("Queued %d appointment reminder(s)", sent)
+	}
+	return nil
+}
+
+func containsMinutes(handled []int64, offset time.Duration) bool {
+	for _, minutes := range handled {
+		if minutes == int64(offset/time.Minute) {
+			return true
+		}
+	}
+	return false
+}
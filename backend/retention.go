@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Personal details on bookings are only kept for BOOKING_RETENTION_MONTHS
+// after the appointment. The booking itself stays for revenue reports. Until
+// the variable is set nothing is changed, and the report shows what would be.
+
+const defaultRetentionMonths = 24
+
+// anonymizeBookingColumns is the SET clause shared by erasure and retention.
+const anonymizeBookingColumns = "name = '" + anonymizedName + "', surname = '', email = '', phone = NULL, user_id = NULL, anonymized_at = NOW()"
+
+type RetentionReport struct {
+	Months        int        `json:"months"`
+	Cutoff        time.Time  `json:"cutoff"`
+	Enforced      bool       `json:"enforced"`
+	Bookings      int        `json:"bookings"`
+	BookingIds    []int      `json:"booking_ids"`
+	OldestBooking *time.Time `json:"oldest_booking"`
+	Emails        int        `json:"emails"`
+}
+
+func bookingRetentionMonths() (int, bool) {
+	months, err := strconv.Atoi(os.Getenv("BOOKING_RETENTION_MONTHS"))
+	if err != nil || months <= 0 {
+		return defaultRetentionMonths, false
+	}
+	return months, true
+}
+
+func retentionCutoff(months int) time.Time {
+	return time.Now().AddDate(0, -months, 0)
+}
+
+// retentionReport lists what enforcing the policy would change, without
+// changing anything.
+func retentionReport(months int) (*RetentionReport, error) {
+	_, enforced := bookingRetentionMonths()
+	report := &RetentionReport{Months: months, Cutoff: retentionCutoff(months), Enforced: enforced, BookingIds: []int{}}
+
+	rows, err := db.Query("SELECT id, end_time FROM bookings WHERE end_time < $1 AND anonymized_at IS NULL ORDER BY end_time", report.Cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch bookings: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var endTime time.Time
+		if err := rows.Scan(&id, &endTime); err != nil {
+			return nil, fmt.Errorf("failed to scan booking: %v", err)
+		}
+		if report.OldestBooking == nil {
+			report.OldestBooking = &endTime
+		}
+		report.BookingIds = append(report.BookingIds, id)
+	}
+	report.Bookings = len(report.BookingIds)
+
+	err = db.QueryRow("SELECT COUNT(*) FROM sent_emails WHERE sent_at < $1", report.Cutoff).Scan(&report.Emails)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count emails: %v", err)
+	}
+	return report, nil
+}
+
+// applyRetention anonymizes bookings and deletes sent emails older than the
+// cutoff, and returns the IDs of the bookings it changed.
+func applyRetention(months int) ([]int, int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to apply retention: %v", err)
+	}
+	defer tx.Rollback()
+
+	var ids []int
+	err = tx.QueryRow(
+		"WITH changed AS (UPDATE bookings SET "+anonymizeBookingColumns+" WHERE end_time < $1 AND anonymized_at IS NULL RETURNING id) SELECT COALESCE(array_agg(id ORDER BY id), '{}') FROM changed",
+		retentionCutoff(months),
+	).Scan(pq.Array(&ids))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to anonymize bookings: %v", err)
+	}
+	_, err = tx.Exec(
+		"UPDATE audit_log SET changes = changes - $2::text[] WHERE entity = 'booking' AND entity_id = ANY($1) AND changes IS NOT NULL",
+		pq.Array(ids), pq.Array(auditPersonalFields),
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to scrub audit entries: %v", err)
+	}
+	res, err := tx.Exec("DELETE FROM sent_emails WHERE sent_at < $1", retentionCutoff(months))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to delete old emails: %v", err)
+	}
+	emails, _ := res.RowsAffected()
+	// SMS rows stay for the cost history, without the number and text.
+	_, err = tx.Exec("UPDATE sms_outbox SET recipient = '', body = '' WHERE created_at < $1 AND recipient <> ''", retentionCutoff(months))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to scrub old text messages: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, fmt.Errorf("failed to apply retention: %v", err)
+	}
+	return ids, emails, nil
+}
+
+func enforceRetention() error {
+	months, enforced := bookingRetentionMonths()
+	if !enforced {
+		return nil
+	}
+	ids, emails, err := applyRetention(months)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 && emails == 0 {
+		return nil
+	}
+	log.Printf("Retention: anonymized %d booking(s) %v and deleted %d email(s) older than %d months", len(ids), ids, emails, months)
+	recordAudit(0, "retention.applied", "booking", 0, "", map[string]interface{}{
+		"months":      months,
+		"booking_ids": ids,
+		"emails":      emails,
+	})
+	return nil
+}
+
+func retentionReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	months, _ := bookingRetentionMonths()
+	if value := r.URL.Query().Get("months"); value != "" {
+		var err error
+		months, err = strconv.Atoi(value)
+		if err != nil || months <= 0 {
+			http.Error(w, "Invalid months", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := retentionReport(months)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
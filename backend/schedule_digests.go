@@ -0,0 +1,282 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Staff get a daily email at a time they choose: stylists an agenda of
+// tomorrow's appointments assigned to them, owners a summary of today's
+// bookings and revenue. Both are on by default for those roles and can be
+// switched on for other staff. Days without appointments are skipped, and
+// schedule_digest_runs makes sure nobody gets the same day twice.
+
+const (
+	DigestAgenda  = "agenda"
+	DigestSummary = "summary"
+
+	scheduleDigestLockKey     = 4701
+	defaultScheduleDigestTime = "19:00"
+)
+
+var scheduleDigestKinds = []string{DigestAgenda, DigestSummary}
+
+type ScheduleDigestSetting struct {
+	Enabled bool   `json:"enabled"`
+	SendAt  string `json:"send_at"`
+}
+
+type ScheduleItem struct {
+	StartTime string
+	EndTime   string
+	Customer  string
+	Phone     string
+	Service   string
+	Price     string
+	Stylist   string
+}
+
+func scheduleDigestTime() string {
+	if value := os.Getenv("SCHEDULE_DIGEST_TIME"); isValidClockTime(value) {
+		return value
+	}
+	return defaultScheduleDigestTime
+}
+
+func isValidClockTime(value string) bool {
+	_, err := time.Parse("15:04", value)
+	return err == nil
+}
+
+// defaultScheduleDigest reports whether a role gets a digest without asking.
+func defaultScheduleDigest(role, kind string) bool {
+	return (kind == DigestAgenda && role == RoleStylist) || (kind == DigestSummary && role == RoleOwner)
+}
+
+// canReceiveScheduleDigest keeps revenue and other stylists' customers away
+// from people who can't see them in the app either.
+func canReceiveScheduleDigest(role, kind string) bool {
+	p := &Principal{Role: role}
+	if kind == DigestSummary {
+		return p.Can(PermViewAllBookings)
+	}
+	return p.IsStaff()
+}
+
+func sendScheduleDigests() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start schedule digests: %v", err)
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", scheduleDigestLockKey).Scan(&locked); err != nil {
+		return fmt.Errorf("failed to take schedule digest lock: %v", err)
+	}
+	if !locked {
+		return nil
+	}
+
+	rows, err := tx.Query(`
+        SELECT users.id, users.email, users.role, COALESCE(users.language, ''), kinds.kind
+        FROM users
+        CROSS JOIN (VALUES ('agenda'), ('summary')) AS kinds(kind)
+        LEFT JOIN schedule_digests ON schedule_digests.user_id = users.id AND schedule_digests.kind = kinds.kind
+        WHERE users.disabled_at IS NULL
+            AND COALESCE(schedule_digests.enabled, (kinds.kind = 'agenda' AND users.role = 'stylist') OR (kinds.kind = 'summary' AND users.role = 'owner'))
+            AND (NOW() AT TIME ZONE $2)::time >= COALESCE(schedule_digests.send_at, $1::time)
+            AND NOT EXISTS (
+                SELECT 1 FROM schedule_digest_runs
+                WHERE schedule_digest_runs.user_id = users.id AND schedule_digest_runs.kind = kinds.kind AND schedule_digest_runs.day = (NOW() AT TIME ZONE $2)::date
+            )
+    `, scheduleDigestTime(), salonTimezone())
+	if err != nil {
+		return fmt.Errorf("failed to fetch digest recipients: %v", err)
+	}
+	type recipient struct {
+		userId            int
+		email, role, lang string
+		kind              string
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.userId, &r.email, &r.role, &r.lang, &r.kind); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan digest recipient: %v", err)
+		}
+		recipients = append(recipients, r)
+	}
+	rows.Close()
+
+	sent := 0
+	for _, r := range recipients {
+		var items []ScheduleItem
+		var day string
+		if canReceiveScheduleDigest(r.role, r.kind) {
+			items, day, err = scheduleItems(tx, r.kind, r.userId)
+			if err != nil {
+				return err
+			}
+		}
+		if len(items) > 0 {
+			data := map[string]interface{}{"Day": day, "Items": items}
+			if r.kind == DigestSummary {
+				data["Revenue"], err = scheduleRevenue(tx)
+				if err != nil {
+					return err
+				}
+			}
+			if err := queueTemplatedEmail(tx, r.email, "schedule_"+r.kind, r.lang, data); err != nil {
+				return err
+			}
+			sent++
+		}
+		_, err = tx.Exec(
+			"INSERT INTO schedule_digest_runs (user_id, kind, day, sent) VALUES ($1, $2, (NOW() AT TIME ZONE $4)::date, $3)",
+			r.userId, r.kind, len(items) > 0, salonTimezone(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record schedule digest: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to finish schedule digests: %v", err)
+	}
+	if sent > 0 {
+		log.Printf("Queued %d schedule digest(s)", sent)
+	}
+	return nil
+}
+
+// scheduleItems returns tomorrow's appointments of a stylist for the agenda,
+// or all of today's for the summary, along with the day they are on.
+func scheduleItems(tx *sql.Tx, kind string, userId int) ([]ScheduleItem, string, error) {
+	daysAhead, stylistId := 0, 0
+	if kind == DigestAgenda {
+		daysAhead, stylistId = 1, userId
+	}
+	rows, err := tx.Query(`
+        SELECT bookings.start_time, bookings.end_time, TRIM(bookings.name || ' ' || COALESCE(bookings.surname, '')), COALESCE(bookings.phone, ''),
+            COALESCE(services.name, ''), COALESCE(services.price::text, ''), COALESCE(TRIM(stylists.name || ' ' || COALESCE(stylists.surname, '')), ''),
+            TO_CHAR(bookings.start_time, 'DD.MM.YYYY')
+        FROM bookings
+        LEFT JOIN services ON services.id = bookings.service
+        LEFT JOIN users AS stylists ON stylists.id = bookings.stylist_id
+        WHERE bookings.start_time >= (NOW() AT TIME ZONE $3)::date + $1::int AND bookings.start_time < (NOW() AT TIME ZONE $3)::date + $1::int + 1
+            AND ($2 = 0 OR bookings.stylist_id = $2)
+        ORDER BY bookings.start_time
+    `, daysAhead, stylistId, salonTimezone())
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch schedule: %v", err)
+	}
+	defer rows.Close()
+
+	var items []ScheduleItem
+	var day string
+	for rows.Next() {
+		var item ScheduleItem
+		err := rows.Scan(&item.StartTime, &item.EndTime, &item.Customer, &item.Phone, &item.Service, &item.Price, &item.Stylist, &day)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to scan schedule: %v", err)
+		}
+		items = append(items, item)
+	}
+	return items, day, nil
+}
+
+func scheduleRevenue(tx *sql.Tx) (string, error) {
+	var revenue string
+	err := tx.QueryRow(`
+        SELECT COALESCE(SUM(services.price), 0)::text FROM bookings
+        JOIN services ON services.id = bookings.service
+        WHERE bookings.start_time >= (NOW() AT TIME ZONE $1)::date AND bookings.start_time < (NOW() AT TIME ZONE $1)::date + 1
+    `, salonTimezone()).Scan(&revenue)
+	if err != nil {
+		return "", fmt.Errorf("failed to calculate revenue: %v", err)
+	}
+	return revenue, nil
+}
+
+func pruneScheduleDigestRuns() error {
+	_, err := db.Exec("DELETE FROM schedule_digest_runs WHERE day < (NOW() AT TIME ZONE $1)::date - 30", salonTimezone())
+	if err != nil {
+		return fmt.Errorf("failed to prune schedule digest runs: %v", err)
+	}
+	return nil
+}
+
+// scheduleDigestsHandler shows (GET) or changes (POST) the caller's digests,
+// e.g. {"agenda": {"enabled": true, "send_at": "20:30"}}.
+func scheduleDigestsHandler(w http.ResponseWriter, r *http.Request) {
+	caller := currentPrincipal(r)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body map[string]ScheduleDigestSetting
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		for kind, setting := range body {
+			if !contains(scheduleDigestKinds, kind) {
+				http.Error(w, fmt.Sprintf("Unknown digest %q", kind), http.StatusBadRequest)
+				return
+			}
+			if setting.Enabled && !canReceiveScheduleDigest(caller.Role, kind) {
+				http.Error(w, fmt.Sprintf("Your role cannot receive the %s digest", kind), http.StatusForbidden)
+				return
+			}
+			if setting.SendAt != "" && !isValidClockTime(setting.SendAt) {
+				http.Error(w, "send_at must look like 19:00", http.StatusBadRequest)
+				return
+			}
+		}
+		for kind, setting := range body {
+			_, err := db.Exec(`
+                INSERT INTO schedule_digests (user_id, kind, enabled, send_at) VALUES ($1, $2, $3, $4)
+                ON CONFLICT (user_id, kind) DO UPDATE SET enabled = EXCLUDED.enabled, send_at = EXCLUDED.send_at
+            `, caller.UserId, kind, setting.Enabled, sql.NullString{String: setting.SendAt, Valid: setting.SendAt != ""})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to save digest settings: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		recordAudit(caller.UserId, "user.digests_updated", "user", caller.UserId, clientIP(r), map[string]interface{}{"digests": body})
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings := map[string]ScheduleDigestSetting{}
+	for _, kind := range scheduleDigestKinds {
+		settings[kind] = ScheduleDigestSetting{Enabled: defaultScheduleDigest(caller.Role, kind), SendAt: scheduleDigestTime()}
+	}
+	rows, err := db.Query("SELECT kind, enabled, COALESCE(TO_CHAR(send_at, 'HH24:MI'), '') FROM schedule_digests WHERE user_id = $1", caller.UserId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch digest settings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var setting ScheduleDigestSetting
+		if err := rows.Scan(&kind, &setting.Enabled, &setting.SendAt); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan digest settings: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if setting.SendAt == "" {
+			setting.SendAt = scheduleDigestTime()
+		}
+		settings[kind] = setting
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Sessions replace the permanent users.api_key for interactive logins. The
+// access token is short-lived; the refresh token is rotated on every use.
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(name); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
+
+func accessTokenTTL() time.Duration {
+	return durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+func refreshTokenTTL() time.Duration {
+	return durationFromEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+type SessionTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	// TOTPEnrollmentRequired tells staff that the 2FA policy blocks their
+	// role until they enroll.
+	TOTPEnrollmentRequired bool `json:"totp_enrollment_required,omitempty"`
+}
+
+func newSessionTokens() (SessionTokens, error) {
+	access, err := generateAPIKey()
+	if err != nil {
+		return SessionTokens{}, err
+	}
+	refresh, err := generateAPIKey()
+	if err != nil {
+		return SessionTokens{}, err
+	}
+	return SessionTokens{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL().Seconds()),
+	}, nil
+}
+
+func createSession(userId int, r *http.Request) (SessionTokens, error) {
+	tokens, err := newSessionTokens()
+	if err != nil {
+		return tokens, err
+	}
+	now := time.Now()
+	_, err = db.Exec(
+		"INSERT INTO sessions (user_id, access_token_hash, refresh_token_hash, access_expires_at, refresh_expires_at, user_agent, ip) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		userId,
+		hashToken(tokens.AccessToken),
+		hashToken(tokens.RefreshToken),
+		now.Add(accessTokenTTL()),
+		now.Add(refreshTokenTTL()),
+		r.UserAgent(),
+		clientIP(r),
+	)
+	if err != nil {
+		return tokens, fmt.Errorf("failed to create session: %v", err)
+	}
+	return tokens, nil
+}
+
+func revokeUserSessions(userId int) error {
+	_, err := db.Exec("UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userId)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %v", err)
+	}
+	return nil
+}
+
+func refreshSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.RefreshToken == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := newSessionTokens()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to generate tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// Rotating the refresh token in the same statement makes the old one
+	// unusable, so a leaked refresh token only works once.
+	var sessionId int
+	err = db.QueryRow(
+		`UPDATE sessions SET access_token_hash = $1, refresh_token_hash = $2, access_expires_at = $3, refresh_expires_at = $4
+        WHERE refresh_token_hash = $5 AND revoked_at IS NULL AND refresh_expires_at > NOW()
+            AND user_id NOT IN (SELECT id FROM users WHERE disabled_at IS NOT NULL)
+        RETURNING id`,
+		hashToken(tokens.AccessToken),
+		hashToken(tokens.RefreshToken),
+		time.Now().Add(accessTokenTTL()),
+		time.Now().Add(refreshTokenTTL()),
+		hashToken(body.RefreshToken),
+	).Scan(&sessionId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to refresh session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caller := currentPrincipal(r)
+	if caller.SessionId == 0 {
+		http.Error(w, "Not logged in with a session token", http.StatusBadRequest)
+		return
+	}
+	_, err := db.Exec("UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", caller.SessionId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to log out: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func logoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caller := currentPrincipal(r)
+	if err := revokeUserSessions(caller.UserId); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to log out: %v", err), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(caller.UserId, "session.revoked_all", "user", caller.UserId, clientIP(r), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caller := currentPrincipal(r)
+	rows, err := db.Query(
+		"SELECT id, created_at, refresh_expires_at, COALESCE(user_agent, ''), COALESCE(ip, '') FROM sessions WHERE user_id = $1 AND revoked_at IS NULL AND refresh_expires_at > NOW() ORDER BY created_at DESC",
+		caller.UserId,
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var sessions []map[string]interface{}
+	for rows.Next() {
+		var id int
+		var createdAt, expiresAt time.Time
+		var userAgent, ip string
+		if err := rows.Scan(&id, &createdAt, &expiresAt, &userAgent, &ip); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan session: %v", err), http.StatusInternalServerError)
+			return
+		}
+		sessions = append(sessions, map[string]interface{}{
+			"id":         id,
+			"created_at": createdAt,
+			"expires_at": expiresAt,
+			"user_agent": userAgent,
+			"ip":         ip,
+			"current":    id == caller.SessionId,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// revokeSessionsHandler lets user managers end sessions of any account, either
+// a single session or all sessions of a user.
+func revokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		UserId    int `json:"user_id"`
+		SessionId int `json:"session_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	var res sql.Result
+	switch {
+	case body.SessionId != 0:
+		res, err = db.Exec("UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", body.SessionId)
+	case body.UserId != 0:
+		res, err = db.Exec("UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", body.UserId)
+	default:
+		http.Error(w, "Missing user_id or session_id", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to revoke sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	revoked, _ := res.RowsAffected()
+	if revoked > 0 {
+		entity, entityId := "session", body.SessionId
+		if body.SessionId == 0 {
+			entity, entityId = "user", body.UserId
+		}
+		recordAudit(currentPrincipal(r).UserId, "session.revoked", entity, entityId, clientIP(r), map[string]interface{}{"count": revoked})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"revoked": revoked})
+}
+
+// apiKeyHandler exposes the long-lived users.api_key for integrations. POST
+// rotates it, which invalidates the old key.
+func apiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if forbidAccessTokens(w, r) {
+		return
+	}
+	caller := currentPrincipal(r)
+	var apiKey string
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		err = db.QueryRow("SELECT api_key FROM users WHERE id = $1", caller.UserId).Scan(&apiKey)
+	case http.MethodPost:
+		apiKey, err = generateAPIKey()
+		if err == nil {
+			_, err = db.Exec("UPDATE users SET api_key = $1 WHERE id = $2", apiKey, caller.UserId)
+		}
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch API key: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPost {
+		recordAudit(caller.UserId, "user.api_key_rotated", "user", caller.UserId, clientIP(r), nil)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"api_key": apiKey})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SMSMessage struct {
+	To   string
+	Body string
+}
+
+// SMSResult is what the provider told us about an accepted message. Status
+// and Cost are optional; gateways that report them later do so through
+// /sms/status.
+type SMSResult struct {
+	ProviderId string
+	Status     string
+	Cost       *float64
+}
+
+// SMSProvider delivers text messages. It is nil when SMS is not configured.
+type SMSProvider interface {
+	Send(msg SMSMessage) (SMSResult, error)
+}
+
+// smsProvider is set up by main from SMS_PROVIDER; see newSMSProviderFromEnv.
+var smsProvider SMSProvider
+
+// HTTPSMSProvider posts {"to", "from", "text"} as JSON to a gateway and
+// expects {"id", "status", "cost"} back, which most providers can be
+// configured or proxied to accept.
+type HTTPSMSProvider struct {
+	URL    string
+	Token  string
+	Sender string
+	Client *http.Client
+}
+
+func (p *HTTPSMSProvider) Send(msg SMSMessage) (SMSResult, error) {
+	payload, err := json.Marshal(map[string]string{"to": msg.To, "from": p.Sender, "text": msg.Body})
+	if err != nil {
+		return SMSResult{}, fmt.Errorf("failed to encode SMS: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(payload))
+	if err != nil {
+		return SMSResult{}, fmt.Errorf("failed to create SMS request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+
+	log.Printf("Sending SMS to %s via %s\n", msg.To, req.URL.Host)
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return SMSResult{}, fmt.Errorf("failed to send SMS: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return SMSResult{}, fmt.Errorf("SMS gateway returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var reply struct {
+		Id     json.RawMessage `json:"id"`
+		Status string          `json:"status"`
+		Cost   *float64        `json:"cost"`
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &reply); err != nil {
+			log.Printf("Ignoring unexpected SMS gateway response: %v", err)
+		}
+	}
+	return SMSResult{
+		ProviderId: trimJSONId(reply.Id),
+		Status:     reply.Status,
+		Cost:       reply.Cost,
+	}, nil
+}
+
+// LogSMSProvider writes messages to a file or stdout instead of sending them,
+// for development and tests.
+type LogSMSProvider struct {
+	Out io.Writer
+	mu  sync.Mutex
+}
+
+func (p *LogSMSProvider) Send(msg SMSMessage) (SMSResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := fmt.Fprintf(p.Out, "--- SMS to %s ---\n%s\n---\n", msg.To, msg.Body)
+	if err != nil {
+		return SMSResult{}, err
+	}
+	return SMSResult{Status: "delivered"}, nil
+}
+
+// newSMSProviderFromEnv picks the implementation from SMS_PROVIDER ("http" or
+// "log"). Without it SMS is disabled and nil is returned.
+func newSMSProviderFromEnv() (SMSProvider, error) {
+	switch kind := os.Getenv("SMS_PROVIDER"); kind {
+	case "":
+		return nil, nil
+	case "http":
+		p := &HTTPSMSProvider{
+			URL:    os.Getenv("SMS_GATEWAY_URL"),
+			Token:  os.Getenv("SMS_GATEWAY_TOKEN"),
+			Sender: os.Getenv("SMS_SENDER"),
+			Client: &http.Client{Timeout: 15 * time.Second},
+		}
+		if p.URL == "" {
+			return nil, fmt.Errorf("SMS_PROVIDER is http but SMS_GATEWAY_URL is not set")
+		}
+		return p, nil
+	case "log":
+		path := os.Getenv("SMS_LOG_FILE")
+		if path == "" {
+			return &LogSMSProvider{Out: os.Stdout}, nil
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open SMS log: %v", err)
+		}
+		return &LogSMSProvider{Out: f}, nil
+	default:
+		return nil, fmt.Errorf("unknown SMS_PROVIDER %q", kind)
+	}
+}
+
+// normalizePhone turns what customers type into the international format
+// gateways expect. Numbers without a country code get SMS_COUNTRY_CODE
+// (48 by default). It returns "" for anything that can't be a phone number.
+func normalizePhone(phone string) string {
+	var digits strings.Builder
+	for i, r := range strings.TrimSpace(phone) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+		case r == ' ' || r == '-' || r == '(' || r == ')' || r == '.':
+		default:
+			return ""
+		}
+	}
+	number := digits.String()
+	switch {
+	case strings.HasPrefix(strings.TrimSpace(phone), "+"):
+	case strings.HasPrefix(number, "00"):
+		number = number[2:]
+	default:
+		code := os.Getenv("SMS_COUNTRY_CODE")
+		if code == "" {
+			code = "48"
+		}
+		number = strings.TrimLeft(code, "+") + strings.TrimLeft(number, "0")
+	}
+	if len(number) < 8 || len(number) > 15 {
+		return ""
+	}
+	return "+" + number
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Text messages go through sms_outbox the same way emails go through
+// email_outbox: queued with the change that caused them, sent by a worker
+// with retries. The table also keeps the price and the delivery status the
+// gateway reports, so SMS spending can be checked per month.
+
+type SMSOutboxMessage struct {
+	Id         int        `json:"id"`
+	BookingId  *int       `json:"booking_id"`
+	Recipient  string     `json:"recipient"`
+	Body       string     `json:"body"`
+	Status     string     `json:"status"`
+	Attempts   int        `json:"attempts"`
+	LastError  string     `json:"last_error"`
+	ProviderId string     `json:"provider_id"`
+	Cost       *float64   `json:"cost"`
+	CreatedAt  time.Time  `json:"created_at"`
+	SentAt     *time.Time `json:"sent_at"`
+}
+
+type SMSCost struct {
+	Month     string  `json:"month"`
+	Messages  int     `json:"messages"`
+	Delivered int     `json:"delivered"`
+	Failed    int     `json:"failed"`
+	Cost      float64 `json:"cost"`
+}
+
+// queueBookingSMS renders the named template for the customer of b and adds it
+// to the outbox as part of tx. Nothing is queued when SMS is disabled, the
+// booking has no usable phone number or the customer turned the category off.
+func queueBookingSMS(tx *sql.Tx, b Booking, name, category string) error {
+	if smsProvider == nil {
+		return nil
+	}
+	to := normalizePhone(b.Phone)
+	if to == "" {
+		return nil
+	}
+	allowed, err := notificationAllowed(tx, b.UserId, b.Email, ChannelSMS, category)
+	if err != nil || !allowed {
+		return err
+	}
+	data, err := bookingEmailData(tx, b)
+	if err != nil {
+		return err
+	}
+	body, err := renderSMS(name, b.Language, data)
+	if err != nil {
+		return err
+	}
+	// A cancelled booking is already deleted, so its message isn't linked.
+	_, err = tx.Exec(
+		"INSERT INTO sms_outbox (booking_id, recipient, body) VALUES ((SELECT id FROM bookings WHERE id = $1), $2, $3)",
+		b.Id, to, body,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to queue SMS: %v", err)
+	}
+	return nil
+}
+
+// deliverSMSOutbox sends the text messages that are due, see deliverOutbox.
+func deliverSMSOutbox() error {
+	if smsProvider == nil {
+		return nil
+	}
+	rows, err := db.Query(`
+        UPDATE sms_outbox SET next_attempt_at = $2
+        WHERE id IN (
+            SELECT id FROM sms_outbox
+            WHERE status = 'pending' AND next_attempt_at <= NOW()
+            ORDER BY next_attempt_at
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, recipient, body, attempts
+    `, outboxBatchSize, time.Now().Add(outboxClaim))
+	if err != nil {
+		return fmt.Errorf("failed to claim SMS outbox: %v", err)
+	}
+	type pending struct {
+		id       int
+		msg      SMSMessage
+		attempts int
+	}
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.msg.To, &p.msg.Body, &p.attempts); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan SMS: %v", err)
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+
+	maxAttempts := outboxMaxAttempts()
+	for _, p := range batch {
+		p.attempts++
+		result, sendErr := smsProvider.Send(p.msg)
+		switch deliveryOutcome(p.attempts, maxAttempts, sendErr) {
+		case deliveryDone:
+			_, err = db.Exec(
+				"UPDATE sms_outbox SET status = $1, attempts = $2, sent_at = NOW(), last_error = NULL, provider_id = $3, cost = $4 WHERE id = $5",
+				smsStatus(result.Status, "sent"), p.attempts, sql.NullString{String: result.ProviderId, Valid: result.ProviderId != ""}, result.Cost, p.id,
+			)
+		case deliveryDead:
+			log.Printf("Giving up on SMS %d to %s after %d attempts: %v", p.id, p.msg.To, p.attempts, sendErr)
+			_, err = db.Exec("UPDATE sms_outbox SET status = 'dead', attempts = $1, last_error = $2 WHERE id = $3", p.attempts, sendErr.Error(), p.id)
+		default:
+			_, err = db.Exec(
+				"UPDATE sms_outbox SET attempts = $1, last_error = $2, next_attempt_at = $3 WHERE id = $4",
+				p.attempts, sendErr.Error(), time.Now().Add(outboxRetryDelay(p.attempts)), p.id,
+			)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update SMS %d: %v", p.id, err)
+		}
+	}
+	return nil
+}
+
+// smsStatus maps the many words gateways use onto the statuses we store.
+func smsStatus(status, fallback string) string {
+	switch status {
+	case "delivered", "DELIVERED", "delivrd", "DELIVRD":
+		return "delivered"
+	case "failed", "FAILED", "undelivered", "UNDELIVERED", "rejected", "REJECTED", "expired", "EXPIRED", "undeliv", "UNDELIV":
+		return "failed"
+	case "sent", "SENT", "accepted", "ACCEPTED", "queued", "QUEUED":
+		return "sent"
+	}
+	return fallback
+}
+
+// smsStatusHandler receives delivery reports from the gateway. The gateway
+// authenticates with SMS_STATUS_TOKEN, either as a bearer token or ?token=.
+func smsStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	expected := os.Getenv("SMS_STATUS_TOKEN")
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var report struct {
+		Id     json.RawMessage `json:"id"`
+		Status string          `json:"status"`
+		Cost   *float64        `json:"cost"`
+		Error  string          `json:"error"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil || len(report.Id) == 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	status := smsStatus(report.Status, "")
+	if status == "" {
+		http.Error(w, "Unknown status", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec(
+		"UPDATE sms_outbox SET status = $1, cost = COALESCE($2, cost), last_error = NULLIF($3, ''), status_updated_at = NOW() WHERE provider_id = $4 AND status IN ('sent', 'delivered', 'failed')",
+		status, report.Cost, report.Error, trimJSONId(report.Id),
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update SMS: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// trimJSONId accepts ids sent as either numbers or strings, since gateways
+// disagree on which to use.
+func trimJSONId(id json.RawMessage) string {
+	var s string
+	if json.Unmarshal(id, &s) == nil {
+		return s
+	}
+	return string(id)
+}
+
+// listSMSHandler shows recent text messages, optionally with one status.
+func listSMSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && smsStatus(status, "") != status && status != "pending" && status != "dead" {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(`
+        SELECT id, booking_id, recipient, body, status, attempts, COALESCE(last_error, ''), COALESCE(provider_id, ''), cost, created_at, sent_at
+        FROM sms_outbox
+        WHERE $1 = '' OR status = $1
+        ORDER BY created_at DESC
+        LIMIT 200
+    `, status)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch SMS: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	messages := []SMSOutboxMessage{}
+	for rows.Next() {
+		var m SMSOutboxMessage
+		err := rows.Scan(&m.Id, &m.BookingId, &m.Recipient, &m.Body, &m.Status, &m.Attempts, &m.LastError, &m.ProviderId, &m.Cost, &m.CreatedAt, &m.SentAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan SMS: %v", err), http.StatusInternalServerError)
+			return
+		}
+		messages = append(messages, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// smsCostsHandler sums up messages and their cost per month.
+func smsCostsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rows, err := db.Query(`
+        SELECT TO_CHAR(DATE_TRUNC('month', created_at), 'YYYY-MM'), COUNT(*),
+            COUNT(*) FILTER (WHERE status = 'delivered'),
+            COUNT(*) FILTER (WHERE status IN ('failed', 'dead')),
+            COALESCE(SUM(cost), 0)
+        FROM sms_outbox
+        WHERE created_at >= DATE_TRUNC('month', NOW()) - make_interval(months => $1)
+        GROUP BY 1
+        ORDER BY 1 DESC
+    `, queryInt(r, "months", 12)-1)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch SMS costs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	costs := []SMSCost{}
+	for rows.Next() {
+		var c SMSCost
+		if err := rows.Scan(&c.Month, &c.Messages, &c.Delivered, &c.Failed, &c.Cost); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan SMS costs: %v", err), http.StatusInternalServerError)
+			return
+		}
+		costs = append(costs, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(costs)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// flakySMSProvider fails the first failures sends.
+type flakySMSProvider struct {
+	failures int
+	calls    int
+	next     SMSProvider
+}
+
+func (p *flakySMSProvider) Send(msg SMSMessage) (SMSResult, error) {
+	p.calls++
+	if p.calls <= p.failures {
+		return SMSResult{}, errors.New("gateway returned status 503")
+	}
+	return p.next.Send(msg)
+}
+
+func TestSMSStatus(t *testing.T) {
+	tests := []struct {
+		status, fallback, want string
+	}{
+		{"DELIVRD", "sent", "delivered"},
+		{"delivered", "sent", "delivered"},
+		{"UNDELIV", "sent", "failed"},
+		{"rejected", "sent", "failed"},
+		{"queued", "sent", "sent"},
+		{"", "sent", "sent"},
+		{"something new", "failed", "failed"},
+	}
+	for _, tt := range tests {
+		if got := smsStatus(tt.status, tt.fallback); got != tt.want {
+			t.Errorf("smsStatus(%q, %q) = %q, want %q", tt.status, tt.fallback, got, tt.want)
+		}
+	}
+}
+
+func TestSMSDelivery(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		wantOutcome  int
+		wantAttempts int
+		wantStatus   string
+	}{
+		{"delivered on first try", 0, deliveryDone, 1, "delivered"},
+		{"delivered after retries", 2, deliveryDone, 3, "delivered"},
+		{"dead-lettered", 100, deliveryDead, outboxDefaultMax, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			p := &flakySMSProvider{failures: tt.failures, next: &LogSMSProvider{Out: &out}}
+			msg := SMSMessage{To: "+48123456789", Body: "Przypomnienie o wizycie jutro o 12:00"}
+
+			var result SMSResult
+			var err error
+			attempts, outcome := 0, deliveryRetry
+			for outcome == deliveryRetry {
+				attempts++
+				result, err = p.Send(msg)
+				outcome = deliveryOutcome(attempts, outboxDefaultMax, err)
+			}
+
+			if outcome != tt.wantOutcome || attempts != tt.wantAttempts {
+				t.Fatalf("got outcome %d after %d attempts, want %d after %d", outcome, attempts, tt.wantOutcome, tt.wantAttempts)
+			}
+			if outcome != deliveryDone {
+				if out.Len() != 0 {
+					t.Errorf("a dead-lettered message was written: %q", out.String())
+				}
+				return
+			}
+			if got := smsStatus(result.Status, "sent"); got != tt.wantStatus {
+				t.Errorf("status %q, want %q", got, tt.wantStatus)
+			}
+			if !strings.Contains(out.String(), "SMS to +48123456789") {
+				t.Errorf("output %q does not mention the recipient", out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Staff are told about booking changes according to notification_routes.
+// Each route sends one event to the booking's stylist, a fixed address (such
+// as a front-desk list) or everyone with a role, either right away or
+// collected into one digest a day.
+
+const (
+	EventBookingCreated   = "booking.created"
+	EventBookingUpdated   = "booking.updated"
+	EventBookingCancelled = "booking.cancelled"
+
+	RouteTargetStylist = "stylist"
+	RouteTargetEmail   = "email"
+	RouteTargetRole    = "role"
+
+	DeliveryInstant = "instant"
+	DeliveryDigest  = "digest"
+
+	defaultDigestHour = 18
+)
+
+var (
+	staffEvents      = []string{EventBookingCreated, EventBookingUpdated, EventBookingCancelled}
+	routeTargets     = []string{RouteTargetStylist, RouteTargetEmail, RouteTargetRole}
+	routeDeliveries  = []string{DeliveryInstant, DeliveryDigest}
+	staffEventEmails = map[string]string{
+		EventBookingCreated:   "booking_created_admin",
+		EventBookingUpdated:   "booking_updated_admin",
+		EventBookingCancelled: "booking_cancelled_admin",
+	}
+)
+
+type NotificationRoute struct {
+	Id        int       `json:"id"`
+	Event     string    `json:"event"`
+	Target    string    `json:"target"`
+	Address   string    `json:"address,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Delivery  string    `json:"delivery"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type staffRecipient struct {
+	email string
+	lang  string
+}
+
+// seedNotificationRoutes keeps the old behaviour on first start: new bookings
+// go to ADMIN_EMAIL. Routes deleted later are not brought back.
+func seedNotificationRoutes(adminEmail string) error {
+	seeded, err := getSetting("notification_routes_seeded", "")
+	if err != nil || seeded != "" {
+		return err
+	}
+	if adminEmail != "" {
+		_, err := db.Exec("INSERT INTO notification_routes (event, target, address) VALUES ($1, $2, $3)", EventBookingCreated, RouteTargetEmail, adminEmail)
+		if err != nil {
+			return fmt.Errorf("failed to create default notification route: %v", err)
+		}
+	}
+	return setSetting("notification_routes_seeded", "true")
+}
+
+// routeRecipients resolves a route to addresses for booking b.
+func routeRecipients(tx *sql.Tx, route NotificationRoute, b Booking) ([]staffRecipient, error) {
+	switch route.Target {
+	case RouteTargetEmail:
+		return []staffRecipient{{email: route.Address, lang: defaultLanguage()}}, nil
+	case RouteTargetStylist:
+		if b.StylistId == 0 {
+			return nil, nil
+		}
+	}
+	rows, err := tx.Query(
+		"SELECT email, COALESCE(language, '') FROM users WHERE disabled_at IS NULL AND (($1 = 'stylist' AND id = $2) OR ($1 = 'role' AND role = $3))",
+		route.Target, b.StylistId, route.Role,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch notification recipients: %v", err)
+	}
+	defer rows.Close()
+	var recipients []staffRecipient
+	for rows.Next() {
+		var r staffRecipient
+		if err := rows.Scan(&r.email, &r.lang); err != nil {
+			return nil, fmt.Errorf("failed to scan notification recipient: %v", err)
+		}
+		if !isValidLanguage(r.lang) {
+			r.lang = defaultLanguage()
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// notifyStaff sends event about b to everyone routed to it, as part of tx.
+// Someone reached by several routes gets a single message, preferring
+// instant delivery over the digest.
+func notifyStaff(tx *sql.Tx, event string, b Booking) error {
+	rows, err := tx.Query("SELECT id, event, target, COALESCE(address, ''), COALESCE(role, ''), delivery FROM notification_routes WHERE event = $1 ORDER BY delivery = 'digest', id", event)
+	if err != nil {
+		return fmt.Errorf("failed to fetch notification routes: %v", err)
+	}
+	var routes []NotificationRoute
+	for rows.Next() {
+		var route NotificationRoute
+		if err := rows.Scan(&route.Id, &route.Event, &route.Target, &route.Address, &route.Role, &route.Delivery); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan notification route: %v", err)
+		}
+		routes = append(routes, route)
+	}
+	rows.Close()
+	if len(routes) == 0 {
+		return nil
+	}
+
+	data, err := bookingEmailData(tx, b)
+	if err != nil {
+		return err
+	}
+	service := data["Service"].(Service)
+	notified := map[string]bool{}
+	for _, route := range routes {
+		recipients, err := routeRecipients(tx, route, b)
+		if err != nil {
+			return err
+		}
+		for _, r := range recipients {
+			key := strings.ToLower(r.email)
+			if r.email == "" || notified[key] {
+				continue
+			}
+			notified[key] = true
+
+			if route.Delivery == DeliveryDigest {
+				_, err = tx.Exec(
+					"INSERT INTO notification_digest_items (recipient, language, event, booking_id, customer, service, start_time, end_time) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+					r.email, r.lang, event, b.Id, strings.TrimSpace(b.Name+" "+b.Surname), service.Name, b.StartTime, b.EndTime,
+				)
+				if err != nil {
+					return fmt.Errorf("failed to add digest item: %v", err)
+				}
+				continue
+			}
+			if err := queueTemplatedEmail(tx, r.email, staffEventEmails[event], r.lang, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func digestHour() int {
+	if hour, err := strconv.Atoi(os.Getenv("NOTIFICATION_DIGEST_HOUR")); err == nil && hour >= 0 && hour < 24 {
+		return hour
+	}
+	return defaultDigestHour
+}
+
+type DigestItem struct {
+	Event     string
+	BookingId int
+	Customer  string
+	Service   string
+	StartTime string
+	EndTime   string
+	CreatedAt time.Time
+}
+
+// sendNotificationDigests mails every recipient the items collected before
+// the most recent NOTIFICATION_DIGEST_HOUR in the salon's timezone, so each
+// gets one digest a day.
+func sendNotificationDigests() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start notification digests: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+        SELECT id, recipient, language, event, COALESCE(booking_id, 0), customer, service, start_time, end_time, created_at
+        FROM notification_digest_items
+        WHERE sent_at IS NULL
+            AND created_at AT TIME ZONE current_setting('TimeZone') AT TIME ZONE $2
+                < DATE_TRUNC('day', (NOW() AT TIME ZONE $2) - make_interval(hours => $1)) + make_interval(hours => $1)
+        ORDER BY recipient, created_at
+        FOR UPDATE SKIP LOCKED
+    `, digestHour(), salonTimezone())
+	if err != nil {
+		return fmt.Errorf("failed to fetch digest items: %v", err)
+	}
+	type digest struct {
+		lang  string
+		ids   []int
+		items []DigestItem
+	}
+	digests := map[string]*digest{}
+	var order []string
+	for rows.Next() {
+		var id int
+		var recipient, lang string
+		var item DigestItem
+		err := rows.Scan(&id, &recipient, &lang, &item.Event, &item.BookingId, &item.Customer, &item.Service, &item.StartTime, &item.EndTime, &item.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan digest item: %v", err)
+		}
+		d, ok := digests[recipient]
+		if !ok {
+			d = &digest{lang: lang}
+			digests[recipient] = d
+			order = append(order, recipient)
+		}
+		d.ids = append(d.ids, id)
+		d.items = append(d.items, item)
+	}
+	rows.Close()
+
+	for _, recipient := range order {
+		d := digests[recipient]
+		err := queueTemplatedEmail(tx, recipient, "notification_digest", d.lang, map[string]interface{}{"Items": d.items})
+		if err != nil {
+			return err
+		}
+		for _, id := range d.ids {
+			if _, err := tx.Exec("UPDATE notification_digest_items SET sent_at = NOW() WHERE id = $1", id); err != nil {
+				return fmt.Errorf("failed to mark digest item: %v", err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to finish notification digests: %v", err)
+	}
+	if len(order) > 0 {
+		log.Printf("Queued %d notification digest(s)", len(order))
+	}
+	return nil
+}
+
+func pruneNotificationDigests() error {
+	_, err := db.Exec("DELETE FROM notification_digest_items WHERE sent_at < $1", time.Now().Add(-7*24*time.Hour))
+	if err != nil {
+		return fmt.Errorf("failed to prune digest items: %v", err)
+	}
+	return nil
+}
+
+// notificationRoutesHandler lists the routes (GET) or adds one (POST).
+func notificationRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var route NotificationRoute
+		if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if route.Delivery == "" {
+			route.Delivery = DeliveryInstant
+		}
+		switch {
+		case !contains(staffEvents, route.Event):
+			http.Error(w, "Invalid event", http.StatusBadRequest)
+			return
+		case !contains(routeTargets, route.Target):
+			http.Error(w, "Invalid target", http.StatusBadRequest)
+			return
+		case !contains(routeDeliveries, route.Delivery):
+			http.Error(w, "Invalid delivery", http.StatusBadRequest)
+			return
+		case route.Target == RouteTargetEmail && !strings.Contains(route.Address, "@"):
+			http.Error(w, "Invalid address", http.StatusBadRequest)
+			return
+		case route.Target == RouteTargetRole && !isValidRole(route.Role):
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+		err := db.QueryRow(
+			"INSERT INTO notification_routes (event, target, address, role, delivery) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			route.Event, route.Target,
+			sql.NullString{String: route.Address, Valid: route.Target == RouteTargetEmail},
+			sql.NullString{String: route.Role, Valid: route.Target == RouteTargetRole},
+			route.Delivery,
+		).Scan(&route.Id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create notification route: %v", err), http.StatusInternalServerError)
+			return
+		}
+		recordAudit(currentPrincipal(r).UserId, "settings.notification_route_created", "notification_route", route.Id, clientIP(r), map[string]interface{}{
+			"event":    route.Event,
+			"target":   route.Target,
+			"address":  route.Address,
+			"role":     route.Role,
+			"delivery": route.Delivery,
+		})
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.Query("SELECT id, event, target, COALESCE(address, ''), COALESCE(role, ''), delivery, created_at FROM notification_routes ORDER BY event, id")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch notification routes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	routes := []NotificationRoute{}
+	for rows.Next() {
+		var route NotificationRoute
+		if err := rows.Scan(&route.Id, &route.Event, &route.Target, &route.Address, &route.Role, &route.Delivery, &route.CreatedAt); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan notification route: %v", err), http.StatusInternalServerError)
+			return
+		}
+		routes = append(routes, route)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routes)
+}
+
+func deleteNotificationRouteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Id int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	res, err := db.Exec("DELETE FROM notification_routes WHERE id = $1", body.Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete notification route: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(currentPrincipal(r).UserId, "settings.notification_route_deleted", "notification_route", body.Id, clientIP(r), nil)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Emails are rendered from templates/<name>.<language>.tmpl. Each file
+// defines a "subject", a plain-text "text" and an "html" block, which are
+// wrapped in the shared layouts. Files in TEMPLATE_DIR take precedence over
+// the built-in ones and are read on every send, so they can be edited without
+// a rebuild or restart.
+
+//go:embed templates/*.tmpl
+var defaultTemplates embed.FS
+
+var supportedLanguages = []string{"pl", "en"}
+
+func isValidLanguage(lang string) bool {
+	for _, supported := range supportedLanguages {
+		if lang == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultLanguage is used for staff emails and for customers who haven't
+// chosen a language.
+func defaultLanguage() string {
+	if lang := os.Getenv("DEFAULT_LANGUAGE"); isValidLanguage(lang) {
+		return lang
+	}
+	return "pl"
+}
+
+func userLanguage(userId int) string {
+	var lang sql.NullString
+	db.QueryRow("SELECT language FROM users WHERE id = $1", userId).Scan(&lang)
+	if isValidLanguage(lang.String) {
+		return lang.String
+	}
+	return defaultLanguage()
+}
+
+type Branding struct {
+	Name    string
+	LogoURL string
+	Address string
+	Phone   string
+	Website string
+}
+
+// salonName is shown in emails, pages and authenticator apps.
+func salonName() string {
+	if name := os.Getenv("SALON_NAME"); name != "" {
+		return name
+	}
+	return "Hairdresser Calendar"
+}
+
+func salonBranding() Branding {
+	return Branding{
+		Name:    salonName(),
+		LogoURL: os.Getenv("SALON_LOGO_URL"),
+		Address: os.Getenv("SALON_ADDRESS"),
+		Phone:   os.Getenv("SALON_PHONE"),
+		Website: appURL(),
+	}
+}
+
+func readTemplate(name string) (string, error) {
+	if dir := os.Getenv("TEMPLATE_DIR"); dir != "" {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return string(content), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read template %s: %v", name, err)
+		}
+	}
+	content, err := defaultTemplates.ReadFile("templates/" + name)
+	if err != nil {
+		return "", fmt.Errorf("template %s not found", name)
+	}
+	return string(content), nil
+}
+
+// formatDateTime shows booking times the way customers write them. Values
+// that don't parse are shown as they are.
+func formatDateTime(value string) string {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Format("02.01.2006 15:04")
+		}
+	}
+	return value
+}
+
+// formatClock shows only the time of day, for lists that are all on one day.
+func formatClock(value string) string {
+	formatted := formatDateTime(value)
+	if i := strings.LastIndex(formatted, " "); i >= 0 && formatted != value {
+		return formatted[i+1:]
+	}
+	return formatted
+}
+
+var templateFuncs = map[string]interface{}{
+	"datetime": formatDateTime,
+	"clock":    formatClock,
+}
+
+// renderEmail builds a message from the named template in the given
+// language, falling back to the default language when there is no variant.
+func renderEmail(to, name, lang string, data map[string]interface{}) (Message, error) {
+	if !isValidLanguage(lang) {
+		lang = defaultLanguage()
+	}
+	content, err := readTemplate(fmt.Sprintf("%s.%s.tmpl", name, lang))
+	if err != nil && lang != defaultLanguage() {
+		lang = defaultLanguage()
+		content, err = readTemplate(fmt.Sprintf("%s.%s.tmpl", name, lang))
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	textLayout, err := readTemplate("layout.txt.tmpl")
+	if err != nil {
+		return Message{}, err
+	}
+	htmlLayout, err := readTemplate("layout.html.tmpl")
+	if err != nil {
+		return Message{}, err
+	}
+
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["Lang"] = lang
+	data["Salon"] = salonBranding()
+	data["AppURL"] = appURL()
+
+	text, err := texttemplate.New(name).Funcs(templateFuncs).Parse(textLayout)
+	if err == nil {
+		_, err = text.Parse(content)
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to parse template %s: %v", name, err)
+	}
+	html, err := htmltemplate.New(name).Funcs(templateFuncs).Parse(htmlLayout)
+	if err == nil {
+		_, err = html.Parse(content)
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to parse template %s: %v", name, err)
+	}
+
+	var subject, body, htmlBody bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Message{}, fmt.Errorf("failed to render %s subject: %v", name, err)
+	}
+	if err := text.ExecuteTemplate(&body, "text_layout", data); err != nil {
+		return Message{}, fmt.Errorf("failed to render %s text: %v", name, err)
+	}
+	if err := html.ExecuteTemplate(&htmlBody, "html_layout", data); err != nil {
+		return Message{}, fmt.Errorf("failed to render %s html: %v", name, err)
+	}
+	return Message{
+		To:      to,
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Body:    strings.TrimSpace(body.String()) + "\n",
+		HTML:    htmlBody.String(),
+	}, nil
+}
+
+// renderSMS renders the "sms" block of the named template. Text messages have
+// no layout; they are kept short and without markup.
+func renderSMS(name, lang string, data map[string]interface{}) (string, error) {
+	if !isValidLanguage(lang) {
+		lang = defaultLanguage()
+	}
+	content, err := readTemplate(fmt.Sprintf("%s.%s.tmpl", name, lang))
+	if err != nil && lang != defaultLanguage() {
+		lang = defaultLanguage()
+		content, err = readTemplate(fmt.Sprintf("%s.%s.tmpl", name, lang))
+	}
+	if err != nil {
+		return "", err
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["Lang"] = lang
+	data["Salon"] = salonBranding()
+	data["AppURL"] = appURL()
+
+	tmpl, err := texttemplate.New(name).Funcs(templateFuncs).Parse(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template %s: %v", name, err)
+	}
+	var body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&body, "sms", data); err != nil {
+		return "", fmt.Errorf("failed to render %s SMS: %v", name, err)
+	}
+	return strings.Join(strings.Fields(body.String()), " "), nil
+}
+
+func sendTemplatedEmail(to, name, lang string, data map[string]interface{}) error {
+	msg, err := renderEmail(to, name, lang, data)
+	if err != nil {
+		return err
+	}
+	return sendEmail(msg)
+}
+
+func queueTemplatedEmail(tx *sql.Tx, to, name, lang string, data map[string]interface{}) error {
+	msg, err := renderEmail(to, name, lang, data)
+	if err != nil {
+		return err
+	}
+	return queueEmail(tx, msg)
+}
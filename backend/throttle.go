@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Login throttling is keyed by the submitted email rather than by user ID, so
+// it behaves the same for addresses that have no account and doesn't reveal
+// which ones are registered.
+
+const (
+	loginFreeAttemptsPerAccount = 5
+	loginLockoutAfter           = 10
+	loginFreeAttemptsPerIP      = 20
+	loginMaxBackoff             = 15 * time.Minute
+)
+
+// dummyPasswordHash is compared against when the email is unknown.
+var dummyPasswordHash, _ = encryptPassword("not a real password")
+
+func loginWindow() time.Duration {
+	return durationFromEnv("LOGIN_ATTEMPT_WINDOW", 15*time.Minute)
+}
+
+func loginLockoutDuration() time.Duration {
+	return durationFromEnv("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+}
+
+// backoff doubles the wait for every failure past the free attempts.
+func backoff(failures, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+	delay := time.Duration(math.Pow(2, float64(failures-free))) * time.Second
+	if delay > loginMaxBackoff || delay <= 0 {
+		return loginMaxBackoff
+	}
+	return delay
+}
+
+// recentFailures counts failed logins for the email since its last success
+// within the window, and returns when the latest one happened.
+func recentFailures(email string) (int, time.Time, error) {
+	return countFailures(`
+        SELECT COUNT(*), MAX(attempted_at) FROM login_attempts
+        WHERE email = $1 AND NOT succeeded AND attempted_at > $2
+            AND attempted_at > COALESCE((SELECT MAX(attempted_at) FROM login_attempts WHERE email = $1 AND succeeded), 'epoch')
+    `, email)
+}
+
+// recentIPFailures counts failed logins from the IP within the window. A
+// success only clears the earlier failures for the same email from that IP,
+// so logging into an account of one's own doesn't reset guesses at others.
+func recentIPFailures(ip string) (int, time.Time, error) {
+	return countFailures(`
+        SELECT COUNT(*), MAX(attempted_at) FROM login_attempts AS failed
+        WHERE ip = $1 AND NOT succeeded AND attempted_at > $2
+            AND NOT EXISTS (
+                SELECT 1 FROM login_attempts
+                WHERE ip = failed.ip AND email = failed.email AND succeeded AND attempted_at > failed.attempted_at
+            )
+    `, ip)
+}
+
+func countFailures(query, value string) (int, time.Time, error) {
+	var count int
+	var last sql.NullTime
+	err := db.QueryRow(query, value, time.Now().Add(-loginWindow())).Scan(&count, &last)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to count login attempts: %v", err)
+	}
+	return count, last.Time, nil
+}
+
+// loginRetryAfter returns how long the caller has to wait before the next
+// login attempt for this email from this IP is accepted.
+func loginRetryAfter(email, ip string) (time.Duration, error) {
+	emailFailures, emailLast, err := recentFailures(normalizeEmail(email))
+	if err != nil {
+		return 0, err
+	}
+	ipFailures, ipLast, err := recentIPFailures(ip)
+	if err != nil {
+		return 0, err
+	}
+	return loginWait(time.Now(), emailFailures, emailLast, ipFailures, ipLast), nil
+}
+
+// loginWait combines the account lockout with the account and IP backoff.
+func loginWait(now time.Time, emailFailures int, emailLast time.Time, ipFailures int, ipLast time.Time) time.Duration {
+	var wait time.Duration
+	if emailFailures >= loginLockoutAfter {
+		wait = emailLast.Add(loginLockoutDuration()).Sub(now)
+	} else if d := emailLast.Add(backoff(emailFailures, loginFreeAttemptsPerAccount)).Sub(now); d > wait {
+		wait = d
+	}
+	if d := ipLast.Add(backoff(ipFailures, loginFreeAttemptsPerIP)).Sub(now); d > wait {
+		wait = d
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func recordLoginAttempt(email, ip string, succeeded bool) {
+	_, err := db.Exec("INSERT INTO login_attempts (email, ip, succeeded) VALUES ($1, $2, $3)", normalizeEmail(email), ip, succeeded)
+	if err != nil {
+		log.Printf("Failed to record login attempt: %v", err)
+		return
+	}
+	if succeeded {
+		return
+	}
+
+	failures, _, err := recentFailures(normalizeEmail(email))
+	if err != nil {
+		log.Printf("Failed to check lockout: %v", err)
+		return
+	}
+	if failures == loginLockoutAfter {
+		var userId int
+		db.QueryRow("SELECT id FROM users WHERE LOWER(email) = LOWER($1)", email).Scan(&userId)
+		recordAudit(0, "account.locked", "user", userId, ip, map[string]interface{}{
+			"email":    email,
+			"failures": failures,
+			"until":    time.Now().Add(loginLockoutDuration()),
+		})
+	}
+}
+
+func pruneLoginAttempts() error {
+	_, err := db.Exec("DELETE FROM login_attempts WHERE attempted_at < $1", time.Now().Add(-24*time.Hour))
+	if err != nil {
+		return fmt.Errorf("failed to prune login attempts: %v", err)
+	}
+	return nil
+}
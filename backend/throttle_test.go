@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures, free int
+		want           time.Duration
+	}{
+		{0, 5, 0},
+		{4, 5, 0},
+		{5, 5, time.Second},
+		{6, 5, 2 * time.Second},
+		{9, 5, 16 * time.Second},
+		{15, 5, loginMaxBackoff},
+		{19, 20, 0},
+		{21, 20, 2 * time.Second},
+		{200, 20, loginMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.failures, tt.free); got != tt.want {
+			t.Errorf("backoff(%d, %d) = %v, want %v", tt.failures, tt.free, got, tt.want)
+		}
+	}
+}
+
+func TestLoginWait(t *testing.T) {
+	t.Setenv("LOGIN_LOCKOUT_DURATION", "15m")
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	tests := []struct {
+		name          string
+		emailFailures int
+		emailLast     time.Time
+		ipFailures    int
+		ipLast        time.Time
+		want          time.Duration
+	}{
+		{"no failures", 0, time.Time{}, 0, time.Time{}, 0},
+		{"free attempts", 4, now, 4, now, 0},
+		{"first backoff", 5, now, 5, now, time.Second},
+		{"backoff doubles", 7, now, 7, now, 4 * time.Second},
+		{"backoff already waited out", 7, ago(time.Minute), 7, ago(time.Minute), 0},
+		{"locked out", loginLockoutAfter, now, loginLockoutAfter, now, 15 * time.Minute},
+		{"lockout partly served", loginLockoutAfter + 3, ago(5 * time.Minute), 13, ago(5 * time.Minute), 10 * time.Minute},
+		{"lockout expired", loginLockoutAfter, ago(16 * time.Minute), loginLockoutAfter, ago(16 * time.Minute), 0},
+		{"IP backoff for a fresh account", 0, time.Time{}, 23, now, 8 * time.Second},
+		{"longer of account and IP", 8, now, 24, now, 16 * time.Second},
+		{"IP backoff during lockout", loginLockoutAfter, ago(14 * time.Minute), 40, now, loginMaxBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := loginWait(now, tt.emailFailures, tt.emailLast, tt.ipFailures, tt.ipLast)
+			if got != tt.want {
+				t.Errorf("loginWait = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
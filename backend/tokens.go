@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Personal access tokens are meant for scripts and integrations. They carry a
+// recognisable prefix so authenticate can tell them apart from session tokens
+// and legacy API keys, and only their hash is stored.
+const accessTokenPrefix = "hdc_"
+
+type AccessToken struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Token      string     `json:"token,omitempty"`
+}
+
+func authenticateAccessToken(token string) (*Principal, error) {
+	var p Principal
+	err := db.QueryRow(`
+        UPDATE api_tokens SET last_used_at = NOW()
+        FROM users
+        WHERE api_tokens.token_hash = $1 AND api_tokens.revoked_at IS NULL
+            AND (api_tokens.expires_at IS NULL OR api_tokens.expires_at > NOW())
+            AND users.id = api_tokens.user_id AND users.disabled_at IS NULL
+        RETURNING users.id, users.email, users.role, api_tokens.id, api_tokens.scopes
+    `, hashToken(token)).Scan(&p.UserId, &p.Email, &p.Role, &p.TokenId, pq.Array(&p.Scopes))
+	if err == sql.ErrNoRows {
+		return nil, errInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate access token: %v", err)
+	}
+	return &p, nil
+}
+
+func parseExpiry(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid date %q", value)
+}
+
+// forbidAccessTokens keeps personal access tokens from managing tokens, so a
+// leaked token cannot be used to mint new ones.
+func forbidAccessTokens(w http.ResponseWriter, r *http.Request) bool {
+	if currentPrincipal(r).TokenId != 0 {
+		http.Error(w, "Access tokens cannot manage tokens, log in instead", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+func createAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokens(w, r) {
+		return
+	}
+
+	var body struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresAt string   `json:"expires_at"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(body.Name) == "" || len(body.Scopes) == 0 {
+		http.Error(w, "Missing name or scopes", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range body.Scopes {
+		if !isValidScope(scope) {
+			http.Error(w, fmt.Sprintf("Unknown scope %q", scope), http.StatusBadRequest)
+			return
+		}
+	}
+	expiresAt, err := parseExpiry(body.ExpiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if expiresAt != nil && expiresAt.Before(time.Now()) {
+		http.Error(w, "Expiry date is in the past", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := generateAPIKey()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to generate token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	t := AccessToken{
+		Name:      body.Name,
+		Prefix:    accessTokenPrefix + secret[:8],
+		Scopes:    body.Scopes,
+		ExpiresAt: expiresAt,
+		Token:     accessTokenPrefix + secret,
+	}
+	err = db.QueryRow(
+		"INSERT INTO api_tokens (user_id, name, token_hash, token_prefix, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at",
+		currentPrincipal(r).UserId,
+		t.Name,
+		hashToken(t.Token),
+		t.Prefix,
+		pq.Array(t.Scopes),
+		t.ExpiresAt,
+	).Scan(&t.Id, &t.CreatedAt)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(currentPrincipal(r).UserId, "token.created", "api_token", t.Id, clientIP(r), map[string]interface{}{
+		"name":   t.Name,
+		"prefix": t.Prefix,
+		"scopes": t.Scopes,
+	})
+
+	// The plain token is only ever shown in this response.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+func listAccessTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokens(w, r) {
+		return
+	}
+
+	rows, err := db.Query(
+		"SELECT id, name, token_prefix, scopes, expires_at, last_used_at, created_at FROM api_tokens WHERE user_id = $1 AND revoked_at IS NULL ORDER BY created_at DESC",
+		currentPrincipal(r).UserId,
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tokens := []AccessToken{}
+	for rows.Next() {
+		var t AccessToken
+		err := rows.Scan(&t.Id, &t.Name, &t.Prefix, pq.Array(&t.Scopes), &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan token: %v", err), http.StatusInternalServerError)
+			return
+		}
+		tokens = append(tokens, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// revokeAccessTokenHandler revokes one of the caller's tokens. User managers
+// may revoke tokens belonging to anyone.
+func revokeAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokens(w, r) {
+		return
+	}
+
+	var t AccessToken
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	caller := currentPrincipal(r)
+	res, err := db.Exec(
+		"UPDATE api_tokens SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL AND (user_id = $2 OR $3)",
+		t.Id,
+		caller.UserId,
+		caller.Can(PermManageUsers),
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to revoke token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(caller.UserId, "token.revoked", "api_token", t.Id, clientIP(r), nil)
+	w.WriteHeader(http.StatusOK)
+}
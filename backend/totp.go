@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TOTP as described in RFC 6238: HMAC-SHA1, 30 second steps, 6 digits. A code
+// is accepted one step either side of now and never twice.
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the step the code belongs to, or -1 if it doesn't match
+// any step after lastStep. Codes from one step before or after now are
+// accepted to allow for clock drift.
+func matchTOTP(secret, code string, lastStep int64, now time.Time) int64 {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return -1
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step
+		}
+	}
+	return -1
+}
+
+func totpIssuer() string {
+	return salonName()
+}
+
+func totpProvisioningURI(secret, email string) string {
+	issuer := totpIssuer()
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprintf("%d", totpDigits))
+	query.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+email) + "?" + query.Encode()
+}
+
+// verifyTOTP checks a code against the user's secret and burns its step so
+// the same code can't be replayed.
+func verifyTOTP(userId int, code string) (bool, error) {
+	var secret sql.NullString
+	var lastStep int64
+	err := db.QueryRow("SELECT totp_secret, totp_last_step FROM users WHERE id = $1", userId).Scan(&secret, &lastStep)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch TOTP secret: %v", err)
+	}
+	if !secret.Valid {
+		return false, nil
+	}
+	step := matchTOTP(secret.String, code, lastStep, time.Now())
+	if step < 0 {
+		return false, nil
+	}
+	res, err := db.Exec("UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1", step, userId)
+	if err != nil {
+		return false, fmt.Errorf("failed to store TOTP step: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func useRecoveryCode(userId int, code string) (bool, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	res, err := db.Exec(
+		"UPDATE recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userId,
+		hashToken(code),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to check recovery code: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// generateRecoveryCodes replaces the user's recovery codes and returns the new
+// plain values.
+func generateRecoveryCodes(userId int) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userId); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %v", err)
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(raw)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashToken(codes[i])
+	}
+	_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) SELECT $1, unnest($2::text[])", userId, pq.Array(hashes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %v", err)
+	}
+	return codes, tx.Commit()
+}
+
+func getSetting(key, fallback string) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = $1", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return fallback, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read setting %s: %v", key, err)
+	}
+	return value, nil
+}
+
+func setSetting(key, value string) error {
+	_, err := db.Exec("INSERT INTO settings (key, value) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value", key, value)
+	if err != nil {
+		return fmt.Errorf("failed to store setting %s: %v", key, err)
+	}
+	return nil
+}
+
+func staffRequire2FA() (bool, error) {
+	value, err := getSetting("require_staff_2fa", "false")
+	return value == "true", err
+}
+
+// needsTOTPEnrollment reports whether a staff member is blocked by the 2FA
+// policy because they haven't enabled it yet.
+func needsTOTPEnrollment(userId int) (bool, error) {
+	required, err := staffRequire2FA()
+	if err != nil || !required {
+		return false, err
+	}
+	var enabled bool
+	err = db.QueryRow("SELECT totp_enabled FROM users WHERE id = $1", userId).Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch 2FA status: %v", err)
+	}
+	return !enabled, nil
+}
+
+func enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokens(w, r) {
+		return
+	}
+	caller := currentPrincipal(r)
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to generate secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// The secret stays inactive until a code from it has been confirmed.
+	res, err := db.Exec("UPDATE users SET totp_secret = $1, totp_last_step = 0 WHERE id = $2 AND NOT totp_enabled", secret, caller.UserId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to store secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(secret, caller.Email),
+	})
+}
+
+func confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokens(w, r) {
+		return
+	}
+	caller := currentPrincipal(r)
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	valid, err := verifyTOTP(caller.UserId, body.Code)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to verify code: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+	res, err := db.Exec("UPDATE users SET totp_enabled = TRUE WHERE id = $1 AND NOT totp_enabled", caller.UserId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to enable two-factor authentication: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	codes, err := generateRecoveryCodes(caller.UserId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to generate recovery codes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(caller.UserId, "2fa.enabled", "user", caller.UserId, clientIP(r), nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+func disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokens(w, r) {
+		return
+	}
+	caller := currentPrincipal(r)
+
+	var body struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if caller.IsStaff() {
+		required, err := staffRequire2FA()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if required {
+			http.Error(w, "Two-factor authentication is required for staff accounts", http.StatusForbidden)
+			return
+		}
+	}
+
+	var encryptedPassword string
+	err := db.QueryRow("SELECT password FROM users WHERE id = $1", caller.UserId).Scan(&encryptedPassword)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if decryptPassword(encryptedPassword, body.Password) != nil {
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return
+	}
+	valid, err := verifyTOTP(caller.UserId, body.Code)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to verify code: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+
+	_, err = db.Exec("UPDATE users SET totp_enabled = FALSE, totp_secret = NULL WHERE id = $1", caller.UserId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to disable two-factor authentication: %v", err), http.StatusInternalServerError)
+		return
+	}
+	db.Exec("DELETE FROM recovery_codes WHERE user_id = $1", caller.UserId)
+	recordAudit(caller.UserId, "2fa.disabled", "user", caller.UserId, clientIP(r), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+func regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if forbidAccessTokens(w, r) {
+		return
+	}
+	caller := currentPrincipal(r)
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	valid, err := verifyTOTP(caller.UserId, body.Code)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to verify code: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+	codes, err := generateRecoveryCodes(caller.UserId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to generate recovery codes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(caller.UserId, "2fa.recovery_codes_regenerated", "user", caller.UserId, clientIP(r), nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// staff2FAPolicyHandler reads (GET) or changes (POST) whether every staff
+// account must use two-factor authentication.
+func staff2FAPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RequireStaff2FA bool `json:"require_staff_2fa"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if err := setSetting("require_staff_2fa", fmt.Sprintf("%t", body.RequireStaff2FA)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		caller := currentPrincipal(r)
+		recordAudit(caller.UserId, "settings.updated", "settings", 0, clientIP(r), map[string]interface{}{
+			"require_staff_2fa": body.RequireStaff2FA,
+		})
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	required, err := staffRequire2FA()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body.RequireStaff2FA = required
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	step := now.Unix() / totpPeriod
+	code := func(step int64) string { return totpCode(key, step) }
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		want     int64
+	}{
+		{"current code", secret, code(step), 0, step},
+		{"previous step within skew", secret, code(step - 1), 0, step - 1},
+		{"next step within skew", secret, code(step + 1), 0, step + 1},
+		{"too old", secret, code(step - 2), 0, -1},
+		{"too far ahead", secret, code(step + 2), 0, -1},
+		{"spaces are ignored", secret, code(step)[:3] + " " + code(step)[3:], 0, step},
+		{"lower-case secret", "jbswy3dpehpk3pxp", code(step), 0, step},
+		{"replayed code", secret, code(step), step, -1},
+		{"older than the last used code", secret, code(step - 1), step, -1},
+		{"newer than the last used code", secret, code(step), step - 1, step},
+		{"wrong code", secret, "000000", 0, -1},
+		{"invalid secret", "not base32!", code(step), 0, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.code == "000000" && (code(step-1) == tt.code || code(step) == tt.code || code(step+1) == tt.code) {
+				t.Skip("the wrong code happens to be valid")
+			}
+			if got := matchTOTP(tt.secret, tt.code, tt.lastStep, now); got != tt.want {
+				t.Errorf("matchTOTP = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Endpoints for user managers. Managers cannot disable or delete their own
+// account, so there is always someone left who can undo a mistake.
+
+const (
+	defaultUsersPerPage = 25
+	maxUsersPerPage     = 100
+)
+
+type ManagedUser struct {
+	Id            int        `json:"id"`
+	Name          string     `json:"name"`
+	Surname       string     `json:"surname"`
+	Email         string     `json:"email"`
+	Role          string     `json:"role"`
+	EmailVerified bool       `json:"email_verified"`
+	TOTPEnabled   bool       `json:"totp_enabled"`
+	DisabledAt    *time.Time `json:"disabled_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+type UserPage struct {
+	Users   []ManagedUser `json:"users"`
+	Total   int           `json:"total"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"per_page"`
+}
+
+func queryInt(r *http.Request, name string, fallback int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	role := query.Get("role")
+	if role != "" && !isValidRole(role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	status := query.Get("status")
+	if status != "" && status != "active" && status != "disabled" && status != "unverified" {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	page := UserPage{Users: []ManagedUser{}, Page: queryInt(r, "page", 1), PerPage: queryInt(r, "per_page", defaultUsersPerPage)}
+	if page.PerPage > maxUsersPerPage {
+		page.PerPage = maxUsersPerPage
+	}
+
+	filter := `
+        FROM users
+        WHERE (name ILIKE $1 OR surname ILIKE $1 OR email ILIKE $1)
+            AND ($2 = '' OR role = $2)
+            AND ($3 = ''
+                OR ($3 = 'active' AND disabled_at IS NULL AND email_verified_at IS NOT NULL)
+                OR ($3 = 'disabled' AND disabled_at IS NOT NULL)
+                OR ($3 = 'unverified' AND email_verified_at IS NULL))
+    `
+	args := []interface{}{containsPattern(query.Get("q")), role, status}
+	err := db.QueryRow("SELECT COUNT(*) "+filter, args...).Scan(&page.Total)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to count users: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.Query(
+		"SELECT id, name, COALESCE(surname, ''), email, role, email_verified_at IS NOT NULL, totp_enabled, disabled_at, created_at "+filter+" ORDER BY id LIMIT $4 OFFSET $5",
+		append(args, page.PerPage, (page.Page-1)*page.PerPage)...,
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch users: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u ManagedUser
+		err := rows.Scan(&u.Id, &u.Name, &u.Surname, &u.Email, &u.Role, &u.EmailVerified, &u.TOTPEnabled, &u.DisabledAt, &u.CreatedAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan user: %v", err), http.StatusInternalServerError)
+			return
+		}
+		page.Users = append(page.Users, u)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// queueAccountInvite lets someone whose account was created by a manager choose
+// their own password.
+func queueAccountInvite(tx *sql.Tx, userId int, email string) error {
+	token, err := createEmailToken(tx, userId, "password_reset", durationFromEnv("INVITE_TTL", 72*time.Hour))
+	if err != nil {
+		return err
+	}
+	return queueTemplatedEmail(tx, email, "account_invite", defaultLanguage(), map[string]interface{}{
+		"Link": fmt.Sprintf("%s/reset-password?token=%s", appURL(), token),
+	})
+}
+
+func createUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var u User
+	err := json.NewDecoder(r.Body).Decode(&u)
+	if err != nil || strings.TrimSpace(u.Name) == "" || !strings.Contains(u.Email, "@") {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if u.Role == "" {
+		u.Role = RoleCustomer
+	}
+	if !isValidRole(u.Role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	exists, err := validateUserExistence(u.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		http.Error(w, "Email already registered", http.StatusConflict)
+		return
+	}
+
+	// Nobody knows this password; the user sets their own through the invite.
+	password, err := generateAPIKey()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to generate password: %v", err), http.StatusInternalServerError)
+		return
+	}
+	encryptedPassword, err := encryptPassword(password)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encrypt password: %v", err), http.StatusInternalServerError)
+		return
+	}
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to generate API key: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// The account and its invite are saved together, so a failed invite
+	// doesn't leave behind an account that blocks trying again.
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM users WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NULL", u.Email)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to replace unverified account: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = tx.QueryRow(
+		"INSERT INTO users (name, surname, email, password, api_key, role, email_verified_at) VALUES ($1, $2, $3, $4, $5, $6, NOW()) RETURNING id",
+		u.Name, u.Surname, u.Email, encryptedPassword, apiKey, u.Role,
+	).Scan(&u.Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	registered := RegisteredUser{Id: u.Id, Name: u.Name, Surname: u.Surname, Email: u.Email, Role: u.Role, Source: "staff"}
+	if err := queueWebhookEvent(tx, EventUserRegistered, registered); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to queue webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := queueAccountInvite(tx, u.Id, u.Email); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to queue invite: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(currentPrincipal(r).UserId, "user.created", "user", u.Id, clientIP(r), map[string]interface{}{
+		"email": u.Email,
+		"role":  u.Role,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int{"id": u.Id})
+}
+
+// decodeTargetUser reads {"id": ...} from the body and rejects requests aimed
+// at the caller's own account.
+func decodeTargetUser(w http.ResponseWriter, r *http.Request, target interface{}, id *int) bool {
+	if err := json.NewDecoder(r.Body).Decode(target); err != nil || *id == 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return false
+	}
+	if *id == currentPrincipal(r).UserId {
+		http.Error(w, "You cannot do this to your own account", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+func disableUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Id       int  `json:"id"`
+		Disabled bool `json:"disabled"`
+	}
+	if !decodeTargetUser(w, r, &body, &body.Id) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE users SET disabled_at = CASE WHEN $1 THEN COALESCE(disabled_at, NOW()) END WHERE id = $2", body.Disabled, body.Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if body.Disabled {
+		if err := revokeAllCredentials(tx, body.Id, 0); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	action := "user.enabled"
+	if body.Disabled {
+		action = "user.disabled"
+	}
+	if err := writeAudit(tx, currentPrincipal(r).UserId, action, "user", body.Id, clientIP(r), nil, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteUserHandler removes the account only. Its bookings stay as guest
+// bookings; use /users/erase to remove personal data as well.
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Id int `json:"id"`
+	}
+	if !decodeTargetUser(w, r, &body, &body.Id) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var email string
+	err = tx.QueryRow("DELETE FROM users WHERE id = $1 RETURNING email", body.Id).Scan(&email)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = writeAudit(tx, currentPrincipal(r).UserId, "user.deleted", "user", body.Id, clientIP(r), map[string]interface{}{"email": email}, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func resetUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Id int `json:"id"`
+	}
+	if !decodeTargetUser(w, r, &body, &body.Id) {
+		return
+	}
+
+	var email string
+	err := db.QueryRow("SELECT email FROM users WHERE id = $1", body.Id).Scan(&email)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := sendPasswordReset(body.Id, email); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to send reset link: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(currentPrincipal(r).UserId, "user.password_reset_sent", "user", body.Id, clientIP(r), nil)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Webhooks send booking and account events to URLs configured by the owner.
+// Deliveries are queued with the change that caused them, like emails, and a
+// worker posts them with retries. Every attempt is kept in webhook_deliveries
+// and any delivery can be sent again.
+//
+// Each request is signed with the webhook's secret:
+//
+//	X-Webhook-Signature: t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">
+//
+// Receivers should recompute the HMAC and reject old timestamps.
+
+const (
+	EventUserRegistered = "user.registered"
+
+	webhookTimeout    = 10 * time.Second
+	webhookDefaultMax = 8
+)
+
+var webhookEvents = []string{EventBookingCreated, EventBookingUpdated, EventBookingCancelled, EventUserRegistered}
+
+// webhookClient only connects to public addresses. The check runs on the
+// address actually dialed, so a host that resolves differently after
+// validation (DNS rebinding) or a redirect can't reach internal services.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if !isPublicIP(net.ParseIP(host)) {
+					return fmt.Errorf("webhook target %s is not a public address", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+	},
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which net.IP doesn't
+// count as private.
+var _, sharedAddressSpace, _ = net.ParseCIDR("100.64.0.0/10")
+
+func isPublicIP(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() && !sharedAddressSpace.Contains(ip)
+}
+
+type Webhook struct {
+	Id          int       `json:"id"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Description string    `json:"description"`
+	Active      bool      `json:"active"`
+	Secret      string    `json:"secret,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type WebhookEvent struct {
+	Id        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type WebhookDelivery struct {
+	Id             int        `json:"id"`
+	WebhookId      int        `json:"webhook_id"`
+	Event          string     `json:"event"`
+	Payload        string     `json:"payload"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	ResponseStatus *int       `json:"response_status"`
+	ResponseBody   string     `json:"response_body"`
+	LastError      string     `json:"last_error"`
+	RedeliveryOf   *int       `json:"redelivery_of"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+func webhookMaxAttempts() int {
+	if n, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS")); err == nil && n > 0 {
+		return n
+	}
+	return webhookDefaultMax
+}
+
+// publishBookingEvent tells staff, webhooks and open calendars about a
+// booking change. It runs in the transaction that made the change.
+func publishBookingEvent(tx *sql.Tx, event string, b Booking) error {
+	if err := notifyStaff(tx, event, b); err != nil {
+		return err
+	}
+	if err := queueWebhookEvent(tx, event, b); err != nil {
+		return err
+	}
+	return notifyBookingChange(tx, event, b)
+}
+
+// RegisteredUser is the data of a user.registered event. Source is "signup",
+// "oidc" or "staff" for accounts created by an administrator.
+type RegisteredUser struct {
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	Surname  string `json:"surname"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	Language string `json:"language,omitempty"`
+	Source   string `json:"source"`
+}
+
+// queueWebhookEvent adds a delivery for every active webhook subscribed to
+// event.
+func queueWebhookEvent(q queryer, event string, data interface{}) error {
+	id, err := generateAPIKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate event id: %v", err)
+	}
+	payload, err := json.Marshal(WebhookEvent{Id: id[:32], Event: event, CreatedAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook event: %v", err)
+	}
+	_, err = q.Exec(
+		"INSERT INTO webhook_deliveries (webhook_id, event, payload) SELECT id, $1, $2 FROM webhooks WHERE active AND $1 = ANY(events)",
+		event, string(payload),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to queue webhook event: %v", err)
+	}
+	return nil
+}
+
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// postWebhook sends one delivery. It returns the response status (0 when
+// there was no response) and the start of the response body.
+func postWebhook(deliveryId int, target, secret, event, payload string) (int, string, error) {
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(payload))
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", salonName()+" webhooks")
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(deliveryId))
+	req.Header.Set("X-Webhook-Signature", signWebhook(secret, time.Now().Unix(), []byte(payload)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, string(body), fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, string(body), nil
+}
+
+// deliverWebhooks posts the deliveries that are due, see deliverOutbox.
+func deliverWebhooks() error {
+	rows, err := db.Query(`
+        UPDATE webhook_deliveries SET next_attempt_at = $2
+        FROM webhooks
+        WHERE webhooks.id = webhook_deliveries.webhook_id AND webhook_deliveries.id IN (
+            SELECT webhook_deliveries.id
+            FROM webhook_deliveries
+            JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+            WHERE webhook_deliveries.status = 'pending' AND webhook_deliveries.next_attempt_at <= NOW() AND webhooks.active
+            ORDER BY webhook_deliveries.next_attempt_at
+            LIMIT $1
+            FOR UPDATE OF webhook_deliveries SKIP LOCKED
+        )
+        RETURNING webhook_deliveries.id, webhook_deliveries.event, webhook_deliveries.payload, webhook_deliveries.attempts,
+            webhooks.url, webhooks.secret
+    `, outboxBatchSize, time.Now().Add(outboxClaim))
+	if err != nil {
+		return fmt.Errorf("failed to claim webhook deliveries: %v", err)
+	}
+	type pending struct {
+		id                          int
+		event, payload, url, secret string
+		attempts                    int
+	}
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.event, &p.payload, &p.attempts, &p.url, &p.secret); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan webhook delivery: %v", err)
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+
+	maxAttempts := webhookMaxAttempts()
+	for _, p := range batch {
+		p.attempts++
+		status, body, sendErr := postWebhook(p.id, p.url, p.secret, p.event, p.payload)
+		responseStatus := sql.NullInt64{Int64: int64(status), Valid: status != 0}
+		switch deliveryOutcome(p.attempts, maxAttempts, sendErr) {
+		case deliveryDone:
+			_, err = db.Exec(
+				"UPDATE webhook_deliveries SET status = 'delivered', attempts = $1, response_status = $2, response_body = $3, last_error = NULL, delivered_at = NOW() WHERE id = $4",
+				p.attempts, responseStatus, body, p.id,
+			)
+		case deliveryDead:
+			log.Printf("Giving up on webhook delivery %d to %s after %d attempts: %v", p.id, p.url, p.attempts, sendErr)
+			_, err = db.Exec(
+				"UPDATE webhook_deliveries SET status = 'dead', attempts = $1, response_status = $2, response_body = $3, last_error = $4 WHERE id = $5",
+				p.attempts, responseStatus, body, sendErr.Error(), p.id,
+			)
+		default:
+			_, err = db.Exec(
+				"UPDATE webhook_deliveries SET attempts = $1, response_status = $2, response_body = $3, last_error = $4, next_attempt_at = $5 WHERE id = $6",
+				p.attempts, responseStatus, body, sendErr.Error(), time.Now().Add(outboxRetryDelay(p.attempts)), p.id,
+			)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update webhook delivery %d: %v", p.id, err)
+		}
+	}
+	return nil
+}
+
+func pruneWebhookDeliveries() error {
+	_, err := db.Exec("DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < $1", time.Now().Add(-30*24*time.Hour))
+	if err != nil {
+		return fmt.Errorf("failed to prune webhook deliveries: %v", err)
+	}
+	return nil
+}
+
+func validateWebhook(hook *Webhook) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("Invalid URL")
+	}
+	if len(hook.Events) == 0 {
+		return fmt.Errorf("At least one event is required")
+	}
+	for _, event := range hook.Events {
+		if !contains(webhookEvents, event) {
+			return fmt.Errorf("Unknown event %q", event)
+		}
+	}
+	// Inactive webhooks send nothing, so one pointing somewhere it
+	// shouldn't can still be switched off.
+	if !hook.Active {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("Cannot resolve %s", u.Hostname())
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return fmt.Errorf("URL must point to a public address")
+		}
+	}
+	return nil
+}
+
+func listWebhooks(w http.ResponseWriter) {
+	rows, err := db.Query("SELECT id, url, events, description, active, created_at FROM webhooks ORDER BY id")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch webhooks: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	hooks := []Webhook{}
+	for rows.Next() {
+		var hook Webhook
+		if err := rows.Scan(&hook.Id, &hook.URL, pq.Array(&hook.Events), &hook.Description, &hook.Active, &hook.CreatedAt); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan webhook: %v", err), http.StatusInternalServerError)
+			return
+		}
+		hooks = append(hooks, hook)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// webhooksHandler lists webhooks (GET) or adds one (POST). The signing secret
+// is only shown in the response to POST.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		listWebhooks(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var hook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	hook.Active = true
+	if err := validateWebhook(&hook); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secret, err := generateAPIKey()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to generate secret: %v", err), http.StatusInternalServerError)
+		return
+	}
+	hook.Secret = "whsec_" + secret
+	err = db.QueryRow(
+		"INSERT INTO webhooks (url, events, description, secret) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		hook.URL, pq.Array(hook.Events), hook.Description, hook.Secret,
+	).Scan(&hook.Id, &hook.CreatedAt)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(currentPrincipal(r).UserId, "webhook.created", "webhook", hook.Id, clientIP(r), map[string]interface{}{
+		"url":    hook.URL,
+		"events": hook.Events,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// updateWebhookHandler changes the URL, events or active flag of a webhook.
+// Fields that are left out keep their value.
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Id          int       `json:"id"`
+		URL         *string   `json:"url"`
+		Events      *[]string `json:"events"`
+		Description *string   `json:"description"`
+		Active      *bool     `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	var hook Webhook
+	err := db.QueryRow("SELECT url, events, description, active FROM webhooks WHERE id = $1", body.Id).Scan(&hook.URL, pq.Array(&hook.Events), &hook.Description, &hook.Active)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if body.URL != nil {
+		hook.URL = *body.URL
+	}
+	if body.Events != nil {
+		hook.Events = *body.Events
+	}
+	if body.Description != nil {
+		hook.Description = *body.Description
+	}
+	if body.Active != nil {
+		hook.Active = *body.Active
+	}
+	if err := validateWebhook(&hook); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		"UPDATE webhooks SET url = $1, events = $2, description = $3, active = $4 WHERE id = $5",
+		hook.URL, pq.Array(hook.Events), hook.Description, hook.Active, body.Id,
+	)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// The worker skips inactive webhooks, so their pending deliveries would
+	// wait forever. They can still be sent again after reactivating.
+	if !hook.Active {
+		_, err = tx.Exec("UPDATE webhook_deliveries SET status = 'dead', last_error = 'Webhook deactivated' WHERE webhook_id = $1 AND status = 'pending'", body.Id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to update webhook deliveries: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(currentPrincipal(r).UserId, "webhook.updated", "webhook", body.Id, clientIP(r), map[string]interface{}{
+		"url":    hook.URL,
+		"events": hook.Events,
+		"active": hook.Active,
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Id int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	res, err := db.Exec("DELETE FROM webhooks WHERE id = $1", body.Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(currentPrincipal(r).UserId, "webhook.deleted", "webhook", body.Id, clientIP(r), nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// webhookDeliveriesHandler is the delivery log, filtered by ?webhook_id= and
+// ?status= (pending, delivered or dead).
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "pending" && status != "delivered" && status != "dead" {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	page := queryInt(r, "page", 1)
+
+	rows, err := db.Query(`
+        SELECT id, webhook_id, event, payload, status, attempts, response_status, COALESCE(response_body, ''), COALESCE(last_error, ''),
+            redelivery_of, created_at, delivered_at
+        FROM webhook_deliveries
+        WHERE ($1 = 0 OR webhook_id = $1) AND ($2 = '' OR status = $2)
+        ORDER BY id DESC
+        LIMIT 100 OFFSET $3
+    `, queryInt(r, "webhook_id", 0), status, (page-1)*100)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to fetch webhook deliveries: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&d.Id, &d.WebhookId, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.ResponseStatus, &d.ResponseBody, &d.LastError,
+			&d.RedeliveryOf, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan webhook delivery: %v", err), http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// redeliverWebhookHandler queues a copy of an earlier delivery with the same
+// payload, so receivers can tell it apart by X-Webhook-Delivery but
+// deduplicate on the event id.
+func redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Id int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	var id int
+	err := db.QueryRow(
+		`INSERT INTO webhook_deliveries (webhook_id, event, payload, redelivery_of)
+        SELECT webhook_deliveries.webhook_id, webhook_deliveries.event, webhook_deliveries.payload, webhook_deliveries.id
+        FROM webhook_deliveries JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+        WHERE webhook_deliveries.id = $1 AND webhooks.active
+        RETURNING id`,
+		body.Id,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Delivery not found or its webhook is not active", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to queue redelivery: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(currentPrincipal(r).UserId, "webhook.redelivered", "webhook_delivery", body.Id, clientIP(r), map[string]interface{}{"delivery": id})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"id": id})
+}
+
+// testWebhookHandler queues a ping event for one webhook, regardless of the
+// events it is subscribed to.
+func testWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Id int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	payload, err := json.Marshal(WebhookEvent{Id: "ping", Event: "ping", CreatedAt: time.Now().UTC(), Data: map[string]int{"webhook_id": body.Id}})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode ping: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var id int
+	err = db.QueryRow(
+		"INSERT INTO webhook_deliveries (webhook_id, event, payload) SELECT id, 'ping', $2 FROM webhooks WHERE id = $1 AND active RETURNING id",
+		body.Id, string(payload),
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found or not active", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to queue ping: %v", err), http.StatusInternalServerError)
+		return
+	}
+	recordAudit(currentPrincipal(r).UserId, "webhook.tested", "webhook", body.Id, clientIP(r), map[string]interface{}{"delivery": id})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"id": id})
+}
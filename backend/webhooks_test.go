@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"event":"booking.created","data":{"id":1}}`)
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte("1714564800."))
+	mac.Write(body)
+	want := "t=1714564800,v1=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := signWebhook("whsec_test", 1714564800, body); got != want {
+		t.Errorf("signWebhook = %q, want %q", got, want)
+	}
+	if signWebhook("whsec_other", 1714564800, body) == want {
+		t.Error("signature doesn't depend on the secret")
+	}
+	if signWebhook("whsec_test", 1714564801, body) == want {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+	if signWebhook("whsec_test", 1714564800, []byte(`{}`)) == want {
+		t.Error("signature doesn't depend on the body")
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"100.128.0.1", true},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:192.168.0.1", false},
+		{"::ffff:93.184.216.34", true},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if isPublicIP(nil) {
+		t.Error("isPublicIP(nil) = true")
+	}
+}
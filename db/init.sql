@@ -5,7 +5,15 @@ CREATE TABLE users (
     email TEXT NOT NULL,
     password TEXT NOT NULL,
     api_key TEXT NOT NULL,
-    is_admin BOOLEAN DEFAULT FALSE
+    role TEXT NOT NULL DEFAULT 'customer' CHECK (role IN ('owner', 'receptionist', 'stylist', 'customer')),
+    email_verified_at TIMESTAMP,
+    pending_email TEXT,
+    disabled_at TIMESTAMP,
+    language TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    totp_secret TEXT,
+    totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    totp_last_step BIGINT NOT NULL DEFAULT 0
 );
 
 CREATE TABLE services (
@@ -33,7 +41,269 @@ CREATE TABLE bookings (
     end_time TIMESTAMP NOT NULL,
     phone TEXT,
     service INTEGER REFERENCES services(id) ON DELETE CASCADE,
-    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    stylist_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    language TEXT,
+    anonymized_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
 );
 
-    
\ No newline at end of file
+    
+CREATE TABLE email_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE TABLE sessions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    access_token_hash TEXT NOT NULL UNIQUE,
+    refresh_token_hash TEXT NOT NULL UNIQUE,
+    access_expires_at TIMESTAMP NOT NULL,
+    refresh_expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMP,
+    user_agent TEXT,
+    ip TEXT
+);
+
+CREATE TABLE api_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    token_prefix TEXT NOT NULL,
+    scopes TEXT[] NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMP
+);
+
+CREATE TABLE login_attempts (
+    id SERIAL PRIMARY KEY,
+    email TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    succeeded BOOLEAN NOT NULL,
+    attempted_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX login_attempts_email_idx ON login_attempts (email, attempted_at);
+CREATE INDEX login_attempts_ip_idx ON login_attempts (ip, attempted_at);
+
+CREATE TABLE audit_log (
+    id SERIAL PRIMARY KEY,
+    actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    action TEXT NOT NULL,
+    entity TEXT NOT NULL,
+    entity_id INTEGER,
+    ip TEXT,
+    details JSONB,
+    changes JSONB,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_log_entity_idx ON audit_log (entity, entity_id);
+CREATE INDEX audit_log_actor_idx ON audit_log (actor_id, created_at);
+
+-- Entries can't be deleted or rewritten. The only updates allowed remove
+-- personal data: clearing the actor when their account is deleted, and
+-- clearing details or dropping fields from changes on erasure and retention.
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE'
+        OR NEW.id <> OLD.id OR NEW.action <> OLD.action OR NEW.entity <> OLD.entity
+        OR NEW.entity_id IS DISTINCT FROM OLD.entity_id OR NEW.ip IS DISTINCT FROM OLD.ip
+        OR NEW.created_at <> OLD.created_at
+        OR (NEW.actor_id IS DISTINCT FROM OLD.actor_id AND NEW.actor_id IS NOT NULL)
+        OR (NEW.details IS DISTINCT FROM OLD.details AND NEW.details IS NOT NULL)
+        OR (NEW.changes IS DISTINCT FROM OLD.changes AND NEW.changes IS NOT NULL
+            AND (OLD.changes IS NULL OR NOT OLD.changes @> NEW.changes))
+    THEN
+        RAISE EXCEPTION 'audit_log is append-only';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TABLE recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE TABLE settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);
+
+CREATE TABLE user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE (issuer, subject)
+);
+
+CREATE TABLE oidc_states (
+    state_hash TEXT PRIMARY KEY,
+    code_verifier TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    -- Set when a logged in user links the provider to their account.
+    link_user_id INTEGER REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE sent_emails (
+    id SERIAL PRIMARY KEY,
+    recipient TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    sent_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX sent_emails_recipient_idx ON sent_emails (LOWER(recipient));
+
+CREATE TABLE email_outbox (
+    id SERIAL PRIMARY KEY,
+    recipient TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    html TEXT,
+    unsubscribe_url TEXT,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX email_outbox_due_idx ON email_outbox (next_attempt_at) WHERE status = 'pending';
+
+CREATE TABLE booking_reminders (
+    booking_id INTEGER NOT NULL REFERENCES bookings(id) ON DELETE CASCADE,
+    offset_minutes INTEGER NOT NULL,
+    sent_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (booking_id, offset_minutes)
+);
+
+CREATE TABLE sms_outbox (
+    id SERIAL PRIMARY KEY,
+    booking_id INTEGER REFERENCES bookings(id) ON DELETE SET NULL,
+    recipient TEXT NOT NULL,
+    body TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'delivered', 'failed', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_error TEXT,
+    provider_id TEXT,
+    cost NUMERIC(10, 4),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP,
+    status_updated_at TIMESTAMP
+);
+
+CREATE INDEX sms_outbox_due_idx ON sms_outbox (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX sms_outbox_provider_idx ON sms_outbox (provider_id);
+
+CREATE TABLE notification_profiles (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    email TEXT,
+    unsubscribe_token TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CHECK ((user_id IS NULL) <> (email IS NULL))
+);
+
+CREATE UNIQUE INDEX notification_profiles_email_idx ON notification_profiles (LOWER(email));
+
+CREATE TABLE notification_preferences (
+    profile_id INTEGER NOT NULL REFERENCES notification_profiles(id) ON DELETE CASCADE,
+    channel TEXT NOT NULL CHECK (channel IN ('email', 'sms', 'push')),
+    category TEXT NOT NULL CHECK (category IN ('confirmations', 'reminders', 'marketing')),
+    enabled BOOLEAN NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (profile_id, channel, category)
+);
+
+CREATE TABLE notification_routes (
+    id SERIAL PRIMARY KEY,
+    event TEXT NOT NULL CHECK (event IN ('booking.created', 'booking.updated', 'booking.cancelled')),
+    target TEXT NOT NULL CHECK (target IN ('stylist', 'email', 'role')),
+    address TEXT,
+    role TEXT,
+    delivery TEXT NOT NULL DEFAULT 'instant' CHECK (delivery IN ('instant', 'digest')),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE notification_digest_items (
+    id SERIAL PRIMARY KEY,
+    recipient TEXT NOT NULL,
+    language TEXT NOT NULL,
+    event TEXT NOT NULL,
+    booking_id INTEGER,
+    customer TEXT NOT NULL,
+    service TEXT NOT NULL,
+    start_time TIMESTAMP NOT NULL,
+    end_time TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX notification_digest_items_pending_idx ON notification_digest_items (created_at) WHERE sent_at IS NULL;
+
+CREATE TABLE schedule_digests (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL CHECK (kind IN ('agenda', 'summary')),
+    enabled BOOLEAN NOT NULL,
+    send_at TIME,
+    PRIMARY KEY (user_id, kind)
+);
+
+CREATE TABLE schedule_digest_runs (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    day DATE NOT NULL,
+    sent BOOLEAN NOT NULL,
+    PRIMARY KEY (user_id, kind, day)
+);
+
+CREATE TABLE webhooks (
+    id SERIAL PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT[] NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    response_status INTEGER,
+    response_body TEXT,
+    last_error TEXT,
+    redelivery_of INTEGER REFERENCES webhook_deliveries(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    delivered_at TIMESTAMP
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id, id);
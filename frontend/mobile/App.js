@@ -44,9 +44,22 @@ const App = () => {
   useEffect(() => {
     const checkLoginStatus = async () => {
       try {
-        const storedApiKey = await AsyncStorage.getItem('apiKey');
-        if (storedApiKey) {
-          setApiKey(storedApiKey);
+        // Access tokens are short-lived, so trade the refresh token for a new one
+        const refreshToken = await AsyncStorage.getItem('refreshToken');
+        if (refreshToken) {
+          const res = await fetch(`${API_HOST}/auth/refresh`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ refresh_token: refreshToken }),
+          });
+          if (res.ok) {
+            const data = await res.json();
+            await AsyncStorage.setItem('apiKey', data.access_token);
+            await AsyncStorage.setItem('refreshToken', data.refresh_token);
+            setApiKey(data.access_token);
+          } else {
+            await AsyncStorage.multiRemove(['apiKey', 'refreshToken']);
+          }
         }
       } catch (error) {
         console.error('Failed to load API key from storage', error);
@@ -132,8 +145,9 @@ const App = () => {
         throw new Error(errorData.error || 'Login failed');
       }
       const data = await response.json();
-      await AsyncStorage.setItem('apiKey', data.api_key);
-      setApiKey(data.api_key);
+      await AsyncStorage.setItem('apiKey', data.access_token);
+      await AsyncStorage.setItem('refreshToken', data.refresh_token);
+      setApiKey(data.access_token);
     } catch (error) {
       Alert.alert('Login Error', error.message);
     }
@@ -141,7 +155,12 @@ const App = () => {
 
   const handleLogout = async () => {
     try {
+      await fetch(`${API_HOST}/auth/logout`, {
+        method: 'POST',
+        headers: { Authorization: apiKey },
+      }).catch(() => {});
       await AsyncStorage.removeItem('apiKey');
+      await AsyncStorage.removeItem('refreshToken');
       setApiKey(null);
       // Clear input fields
       setEmail('');
@@ -6,7 +6,8 @@ import RegisterModal from "./components/RegisterModal";
 import Logout from "./components/Logout";
 import AddAppointmentModal from "./components/AddAppointmentModal";
 import AdminPage from "./components/AdminPage"; // <-- import
-import { fetchBookings } from "./utils/api";
+import ResetPassword from "./components/ResetPassword";
+import { fetchBookings, refreshSession } from "./utils/api";
 
 const App = () => {
   const [events, setEvents] = useState([]);
@@ -18,8 +19,11 @@ const App = () => {
   const [isAdmin, setIsAdmin] = useState(false);
   const [showAdmin, setShowAdmin] = useState(false);
 
-  const refreshBookings = () => {
-    const apiKey = Cookies.get("apiKey");
+  const refreshBookings = async () => {
+    // Access tokens are short-lived, so get a fresh one on every page load.
+    const apiKey = Cookies.get("refreshToken")
+      ? await refreshSession()
+      : Cookies.get("apiKey");
     if (apiKey) {
       setIsLoggedIn(true);
       fetchBookings(apiKey, setEvents);
@@ -30,6 +34,14 @@ const App = () => {
   };
 
   useEffect(() => {
+    // After an OIDC login the backend redirects here with the session tokens
+    // in the URL fragment.
+    const fragment = new URLSearchParams(window.location.hash.slice(1));
+    if (fragment.get("access_token")) {
+      Cookies.set("apiKey", fragment.get("access_token"));
+      Cookies.set("refreshToken", fragment.get("refresh_token"));
+      window.history.replaceState(null, "", window.location.pathname);
+    }
     refreshBookings();
   }, []);
 
@@ -65,6 +77,10 @@ const App = () => {
     setShowAddModal(true);
   };
 
+  if (window.location.pathname === "/reset-password") {
+    return <ResetPassword />;
+  }
+
   if (showAdmin) {
     return (
       <AdminPage
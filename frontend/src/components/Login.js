@@ -18,9 +18,10 @@ const Login = ({ setIsLoggedIn, setEvents }) => {
         throw new Error("Login failed");
       }
       const data = await response.json();
-      Cookies.set("apiKey", data.api_key);
+      Cookies.set("apiKey", data.access_token);
+      Cookies.set("refreshToken", data.refresh_token);
       setIsLoggedIn(true);
-      fetchBookings(data.api_key, setEvents);
+      fetchBookings(data.access_token, setEvents);
     } catch (error) {
       console.error("Error logging in:", error);
     }
@@ -6,28 +6,54 @@ const LoginModal = ({ setIsLoggedIn, setEvents, onClose }) => {
   const [email, setEmail] = useState("");
   const [password, setPassword] = useState("");
 
-  const handleLogin = async () => {
+  const handleLogin = async (totpCode) => {
     try {
       const response = await fetch("/auth/login", {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
         },
-        body: JSON.stringify({ email, password }),
+        body: JSON.stringify({ email, password, totp_code: totpCode }),
       });
+      if (response.status === 401 && !totpCode) {
+        const data = await response.json().catch(() => ({}));
+        if (data.totp_required) {
+          const code = prompt("Enter the code from your authenticator app:");
+          if (code) {
+            handleLogin(code);
+          }
+          return;
+        }
+      }
       if (!response.ok) {
         throw new Error("Login failed");
       }
       const data = await response.json();
-      Cookies.set("apiKey", data.api_key);
+      Cookies.set("apiKey", data.access_token);
+      Cookies.set("refreshToken", data.refresh_token);
       setIsLoggedIn(true);
-      fetchBookings(data.api_key, setEvents);
+      fetchBookings(data.access_token, setEvents);
       onClose();
     } catch (error) {
       console.error("Error logging in:", error);
     }
   };
 
+  const handleForgotPassword = async () => {
+    try {
+      const response = await fetch("/auth/forgotPassword", {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+        },
+        body: JSON.stringify({ email }),
+      });
+      alert(await response.text());
+    } catch (error) {
+      console.error("Error requesting password reset:", error);
+    }
+  };
+
   return (
     <div className="modal">
       <div className="modal-content">
@@ -44,7 +70,11 @@ const LoginModal = ({ setIsLoggedIn, setEvents, onClose }) => {
           value={password}
           onChange={(e) => setPassword(e.target.value)}
         />
-        <button onClick={handleLogin}>Login</button>
+        <button onClick={() => handleLogin()}>Login</button>
+        <button onClick={handleForgotPassword}>Forgot password</button>
+        <button onClick={() => (window.location.href = "/auth/oidc/login")}>
+          Sign in with SSO
+        </button>
         <button onClick={onClose}>Close</button>
       </div>
     </div>
@@ -2,8 +2,16 @@ import React from "react";
 import Cookies from "js-cookie";
 
 const Logout = ({ setIsLoggedIn, setEvents }) => {
-  const handleLogout = () => {
+  const handleLogout = async () => {
+    const apiKey = Cookies.get("apiKey");
+    if (apiKey) {
+      await fetch("/auth/logout", {
+        method: "POST",
+        headers: { Authorization: apiKey },
+      }).catch((error) => console.error("Error logging out:", error));
+    }
     Cookies.remove("apiKey");
+    Cookies.remove("refreshToken");
     setIsLoggedIn(false);
     setEvents([]);
     window.location.reload(); // Refresh the page after logout
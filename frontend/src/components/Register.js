@@ -17,7 +17,7 @@ const Register = () => {
       if (!response.ok) {
         throw new Error("Registration failed");
       }
-      alert("Registration successful! Please log in.");
+      alert("Registration successful! Check your inbox to verify your email, then log in.");
     } catch (error) {
       console.error("Error registering:", error);
     }
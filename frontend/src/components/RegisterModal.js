@@ -19,7 +19,7 @@ const RegisterModal = ({ onClose }) => {
       if (!response.ok) {
         throw new Error("Registration failed");
       }
-      alert("Registration successful! Please log in.");
+      alert("Registration successful! Check your inbox to verify your email, then log in.");
       onClose();
     } catch (error) {
       console.error("Error registering:", error);
@@ -0,0 +1,40 @@
+import React, { useState } from "react";
+
+// Landing page for the link sent by /auth/forgotPassword.
+const ResetPassword = () => {
+  const token = new URLSearchParams(window.location.search).get("token");
+  const [password, setPassword] = useState("");
+  const [message, setMessage] = useState("");
+
+  const handleReset = async () => {
+    try {
+      const response = await fetch("/auth/resetPassword", {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+        },
+        body: JSON.stringify({ token, password }),
+      });
+      setMessage(await response.text());
+    } catch (error) {
+      console.error("Error resetting password:", error);
+    }
+  };
+
+  return (
+    <div>
+      <h1>Reset password</h1>
+      <input
+        type="password"
+        placeholder="New password"
+        value={password}
+        onChange={(e) => setPassword(e.target.value)}
+      />
+      <button onClick={handleReset}>Set password</button>
+      {message && <p>{message}</p>}
+      <a href="/">Back to calendar</a>
+    </div>
+  );
+};
+
+export default ResetPassword;
@@ -1,3 +1,33 @@
+import Cookies from "js-cookie";
+
+// Exchanges the stored refresh token for a new access token. Returns the new
+// access token, or null when the session can no longer be refreshed.
+export const refreshSession = async () => {
+  const refreshToken = Cookies.get("refreshToken");
+  if (!refreshToken) {
+    return null;
+  }
+  try {
+    const response = await fetch("/auth/refresh", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ refresh_token: refreshToken }),
+    });
+    if (!response.ok) {
+      throw new Error("Failed to refresh session");
+    }
+    const data = await response.json();
+    Cookies.set("apiKey", data.access_token);
+    Cookies.set("refreshToken", data.refresh_token);
+    return data.access_token;
+  } catch (error) {
+    console.error("Error refreshing session:", error);
+    Cookies.remove("apiKey");
+    Cookies.remove("refreshToken");
+    return null;
+  }
+};
+
 export const fetchBookings = async (apiKey, setEvents) => {
   try {
     const response = await fetch("/bookings/get", {